@@ -0,0 +1,307 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/zackbloom/goamz/cloudfront"
+	"github.com/zackbloom/goamz/iam"
+	"github.com/zackbloom/goamz/route53"
+	"github.com/zackbloom/goamz/s3"
+	"golang.org/x/net/publicsuffix"
+)
+
+func (r *run) createBucket(options Options) error {
+	bucket := r.S3.Bucket(options.Bucket)
+
+	if r.planned(PlannedAction{Action: "s3:CreateBucket", Path: options.Bucket, Detail: "public-read"}) {
+		r.planned(PlannedAction{Action: "s3:PutBucketWebsite", Path: options.Bucket, Detail: "index index.html, error error.html"})
+		r.planned(PlannedAction{Action: "s3:PutBucketPolicy", Path: options.Bucket, Detail: "public s3:GetObject on arn:aws:s3:::" + options.Bucket + "/*, except Stout's own files"})
+		return nil
+	}
+
+	err := bucket.PutBucket("public-read")
+	if err != nil {
+		return err
+	}
+
+	err = bucket.PutBucketWebsite(s3.WebsiteConfiguration{
+		IndexDocument: &s3.IndexDocument{"index.html"},
+		ErrorDocument: &s3.ErrorDocument{"error.html"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The policy would otherwise make the manifests, lock and routing rule record public, whatever
+	// their ACL says
+	err = bucket.PutPolicy([]byte(`{
+			"Version": "2008-10-17",
+			"Statement": [
+				{
+					"Sid": "PublicReadForGetBucketObjects",
+					"Effect": "Allow",
+					"Principal": {
+						"AWS": "*"
+					},
+					"Action": "s3:GetObject",
+					"NotResource": [
+						"arn:aws:s3:::` + options.Bucket + `/*` + MANIFEST_NAME + `",
+						"arn:aws:s3:::` + options.Bucket + `/*` + LOCK_NAME + `",
+						"arn:aws:s3:::` + options.Bucket + `/*` + ROUTING_RULES_NAME + `"
+					]
+				}
+			]
+		}`,
+	))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *run) getDistribution(options Options) (dist cloudfront.DistributionSummary, err error) {
+	distP, err := r.CloudFront.FindDistributionByAlias(options.Bucket)
+	if err != nil {
+		return
+	}
+
+	if distP != nil {
+		r.printf("CloudFront distribution found with the provided bucket name, assuming config matches.\n")
+		r.printf("If you run into issues, delete the distribution and rerun this command.\n")
+
+		dist = *distP
+		return
+	}
+
+	conf := cloudfront.DistributionConfig{
+		Origins: cloudfront.Origins{
+			cloudfront.Origin{
+				Id:         "S3-" + options.Bucket,
+				DomainName: options.Bucket + ".s3-website-" + options.AWSRegion + ".amazonaws.com",
+				CustomOriginConfig: &cloudfront.CustomOriginConfig{
+					HTTPPort:             80,
+					HTTPSPort:            443,
+					OriginProtocolPolicy: "http-only",
+				},
+			},
+		},
+		DefaultRootObject: "index.html",
+		PriceClass:        "PriceClass_All",
+		Enabled:           true,
+		DefaultCacheBehavior: cloudfront.CacheBehavior{
+			TargetOriginId:       "S3-" + options.Bucket,
+			ViewerProtocolPolicy: "allow-all",
+			AllowedMethods: cloudfront.AllowedMethods{
+				Allowed: []string{"GET", "HEAD"},
+				Cached:  []string{"GET", "HEAD"},
+			},
+		},
+		ViewerCertificate: &cloudfront.ViewerCertificate{
+			CloudFrontDefaultCertificate: true,
+			MinimumProtocolVersion:       "TLSv1",
+			SSLSupportMethod:             "sni-only",
+		},
+		CustomErrorResponses: cloudfront.CustomErrorResponses{
+			// This adds support for single-page apps
+			cloudfront.CustomErrorResponse{
+				ErrorCode:          403,
+				ResponsePagePath:   "/index.html",
+				ResponseCode:       200,
+				ErrorCachingMinTTL: 60,
+			},
+			cloudfront.CustomErrorResponse{
+				ErrorCode:          404,
+				ResponsePagePath:   "/index.html",
+				ResponseCode:       200,
+				ErrorCachingMinTTL: 60,
+			},
+		},
+		Aliases: cloudfront.Aliases{
+			options.Bucket,
+		},
+	}
+
+	if r.planned(PlannedAction{Action: "cloudfront:CreateDistribution", Path: options.Bucket, Detail: "origin " + conf.Origins[0].DomainName}) {
+		dist.DistributionConfig = conf
+		dist.DomainName = "(new distribution)"
+		return
+	}
+
+	return r.CloudFront.Create(conf)
+}
+
+func (r *run) createUser(options Options) (key iam.AccessKey, err error) {
+	name := options.Bucket + "_deploy"
+
+	if r.planned(PlannedAction{Action: "iam:CreateUser", Path: name}) {
+		r.planned(PlannedAction{Action: "iam:PutUserPolicy", Path: name, Detail: "s3 access to arn:aws:s3:::" + options.Bucket})
+		r.planned(PlannedAction{Action: "iam:CreateAccessKey", Path: name})
+		return
+	}
+
+	_, err = r.IAM.CreateUser(name, "/")
+	if err != nil {
+		iamErr, ok := err.(*iam.Error)
+		if ok && iamErr.Code == "EntityAlreadyExists" {
+			err = nil
+		} else {
+			return
+		}
+	}
+
+	_, err = r.IAM.PutUserPolicy(name, name, `{
+			"Version": "2012-10-17",
+			"Statement": [
+				{
+					"Effect": "Allow",
+					"Action": [
+						"s3:DeleteObject",
+						"s3:ListBucket",
+						"s3:PutObject",
+						"s3:PutObjectAcl",
+						"s3:GetObject",
+						"s3:GetBucketWebsite",
+						"s3:PutBucketWebsite"
+					],
+					"Resource": [
+						"arn:aws:s3:::`+options.Bucket+`", "arn:aws:s3:::`+options.Bucket+`/*"
+					]
+				}
+			]
+		}`,
+	)
+	if err != nil {
+		return
+	}
+
+	keyResp, err := r.IAM.CreateAccessKey(name)
+	if err != nil {
+		return
+	}
+
+	return keyResp.AccessKey, nil
+}
+
+func (r *run) updateRoute(options Options, dist cloudfront.DistributionSummary) error {
+	zoneName, err := publicsuffix.EffectiveTLDPlusOne(options.Bucket)
+	if err != nil {
+		return err
+	}
+
+	zoneName = zoneName + "."
+
+	resp, err := r.Route53.ListHostedZonesByName(zoneName, "", 100)
+	if err != nil {
+		return err
+	}
+
+	if resp.IsTruncated {
+		panic("More than 100 zones in the account")
+	}
+
+	var zone *route53.HostedZone
+	for _, z := range resp.HostedZones {
+		if z.Name == zoneName {
+			zone = &z
+			break
+		}
+	}
+
+	if zone == nil {
+		r.printf("A Route 53 hosted zone was not found for %s\n", zoneName)
+		if zoneName != options.Bucket {
+			r.printf("If you would like to use Route 53 to manage your DNS, create a zone for this domain, and update your registrar's configuration to point to the DNS servers Amazon provides and rerun this command.  Note that you must copy any existing DNS configuration you have to Route 53 if you do not wish existing services hosted on this domain to stop working.\n")
+			r.printf("If you would like to continue to use your existing DNS, create a CNAME record pointing %s to %s and the site setup will be finished.\n", options.Bucket, dist.DomainName)
+		} else {
+			r.printf("Since you are hosting the root of your domain, using an alternative DNS host is unfortunately not possible.\n")
+			r.printf("If you wish to host your site at the root of your domain, you must switch your sites DNS to Amazon's Route 53 and retry this command.\n")
+		}
+
+		return nil
+	}
+
+	r.printf("Adding %s to %s Route 53 zone\n", options.Bucket, zone.Name)
+	parts := strings.Split(zone.Id, "/")
+	idValue := parts[2]
+
+	if r.planned(PlannedAction{Action: "route53:ChangeResourceRecordSets", Path: options.Bucket, Detail: "CREATE A alias to " + dist.DomainName + " in " + zone.Name}) {
+		return nil
+	}
+
+	_, err = r.Route53.ChangeResourceRecordSet(&route53.ChangeResourceRecordSetsRequest{
+		Changes: []route53.Change{
+			route53.Change{
+				Action: "CREATE",
+				Name:   options.Bucket,
+				Type:   "A",
+				AliasTarget: route53.AliasTarget{
+					HostedZoneId:         "Z2FDTNDATAQYW2",
+					DNSName:              dist.DomainName,
+					EvaluateTargetHealth: false,
+				},
+			},
+		},
+	}, idValue)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "it already exists") {
+			r.printf("Existing route found, assuming it is correct\n")
+			r.printf("If you run into trouble, you may need to delete the %s route in Route53 and try again\n", options.Bucket)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Create makes the bucket, CloudFront distribution, Route 53 record and (unless options.NoUser is set)
+// the IAM user a site needs.  The result has the credentials of the user.
+func (c *Client) Create(ctx context.Context, options Options) (result *CreateResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	if options.Local != "" {
+		return nil, configError("Create makes an S3 bucket, it can't be used with --local")
+	}
+
+	r := c.start(ctx, options)
+
+	r.printf("Creating Bucket\n")
+	if err := r.createBucket(options); err != nil {
+		return nil, wrapError(err, "Error creating S3 bucket")
+	}
+
+	r.printf("Loading/Creating CloudFront Distribution\n")
+	dist, err := r.getDistribution(options)
+
+	if err != nil {
+		return nil, wrapError(err, "Error loading/creating CloudFront distribution")
+	}
+
+	r.printf("Adding Route\n")
+	if err := r.updateRoute(options, dist); err != nil {
+		return nil, wrapError(err, "Error adding route to Route53 DNS config")
+	}
+
+	var key iam.AccessKey
+	if !options.NoUser {
+		key, err = r.createUser(options)
+
+		if err != nil {
+			return nil, wrapError(err, "Error creating user")
+		}
+	}
+
+	return &CreateResult{
+		Result:          r.result(options, "create", start),
+		Bucket:          options.Bucket,
+		Distribution:    dist.Id,
+		DomainName:      dist.DomainName,
+		AccessKeyId:     key.Id,
+		AccessKeySecret: key.Secret,
+	}, nil
+}
@@ -0,0 +1,241 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/zackbloom/goamz/aws"
+)
+
+// In atomic mode, the whole site is served from its deploy id by pointing the origin path of a CloudFront
+// distribution at it.  goamz can't update a distribution, so we make those requests ourselves.  The
+// config is edited as XML text, so any settings goamz doesn't know about are left intact.
+const CLOUDFRONT_API = "https://cloudfront.amazonaws.com/2014-11-06/distribution/"
+
+var (
+	originRe     = regexp.MustCompile(`(?s)<Origin>.*?</Origin>`)
+	originIdRe   = regexp.MustCompile(`<Id>([^<]*)</Id>`)
+	domainNameRe = regexp.MustCompile(`<DomainName>([^<]*)</DomainName>`)
+	originPathRe = regexp.MustCompile(`<OriginPath>([^<]*)</OriginPath>|<OriginPath\s*/>`)
+)
+
+func checkAtomic(o Options) {
+	if !o.Atomic {
+		return
+	}
+
+	if o.Local != "" {
+		panic(configError("Atomic deploys are made by CloudFront, so they can't be used with --local"))
+	}
+	if o.Distribution == "" {
+		panic(configError("Atomic deploys require the id of the CloudFront distribution serving the site (--distribution)"))
+	}
+	if destPrefix(o) != "" {
+		panic(configError("Atomic deploys must be made to the root of the bucket, as the whole distribution is served from the deploy id"))
+	}
+}
+
+func (r *run) cloudFrontRequest(method, path string, body []byte, etag string) (data []byte, respETag string) {
+	if r.CloudFront == nil {
+		panic("The client doesn't have a CloudFront session")
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else {
+		reader = bytes.NewReader([]byte{})
+	}
+
+	req := must(http.NewRequest(method, CLOUDFRONT_API+path, reader)).(*http.Request)
+	req = req.WithContext(r.ctx)
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+
+	r.CloudFront.Signer.Sign(req)
+
+	resp := must(http.DefaultClient.Do(req)).(*http.Response)
+	defer resp.Body.Close()
+
+	data = must(ioutil.ReadAll(resp.Body)).([]byte)
+
+	if resp.StatusCode >= 400 {
+		errors := aws.ErrorResponse{}
+		xml.Unmarshal(data, &errors)
+
+		err := errors.Errors
+		err.RequestId = errors.RequestId
+		err.StatusCode = resp.StatusCode
+		if err.Message == "" {
+			err.Message = resp.Status
+		}
+		panic(&err)
+	}
+
+	return data, resp.Header.Get("ETag")
+}
+
+// findOrigin returns the location of the origin the site is served from in the distribution config.  It's
+// the origin named by options.Origin, or the only origin, or the origin pointing at the bucket.
+func findOrigin(options Options, config []byte) []int {
+	origins := originRe.FindAllIndex(config, -1)
+
+	for _, loc := range origins {
+		origin := config[loc[0]:loc[1]]
+
+		id := originIdRe.FindSubmatch(origin)
+		domain := domainNameRe.FindSubmatch(origin)
+
+		switch {
+		case options.Origin != "":
+			if id != nil && string(id[1]) == options.Origin {
+				return loc
+			}
+		case len(origins) == 1:
+			return loc
+		case domain != nil && strings.HasPrefix(string(domain[1]), options.Bucket+"."):
+			return loc
+		}
+	}
+
+	panic(configError("Unable to find the origin of distribution %s which serves the site, specify it with --origin", options.Distribution))
+}
+
+func (r *run) getOriginPath(options Options) string {
+	config, _ := r.cloudFrontRequest("GET", options.Distribution+"/config", nil, "")
+
+	loc := findOrigin(options, config)
+	match := originPathRe.FindSubmatch(config[loc[0]:loc[1]])
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// liveDeployId is the deploy the distribution is serving in atomic mode, or an empty string if it's
+// not serving one.
+func (r *run) liveDeployId(options Options) string {
+	return strings.Trim(r.getOriginPath(options), "/")
+}
+
+// setOriginPath points the distribution at the deploy id.  Every page switches at once, although it
+// takes CloudFront a few minutes to apply the change everywhere.
+func (r *run) setOriginPath(options Options, id string) {
+	config, etag := r.cloudFrontRequest("GET", options.Distribution+"/config", nil, "")
+
+	loc := findOrigin(options, config)
+	origin := config[loc[0]:loc[1]]
+
+	path := "/" + id
+	element := []byte("<OriginPath>" + path + "</OriginPath>")
+
+	var updated []byte
+	if originPathRe.Match(origin) {
+		updated = originPathRe.ReplaceAll(origin, element)
+	} else {
+		// OriginPath comes directly after the DomainName
+		domain := domainNameRe.FindIndex(origin)
+		updated = append(append(append([]byte{}, origin[:domain[1]]...), element...), origin[domain[1]:]...)
+	}
+
+	if bytes.Equal(updated, origin) {
+		log.Printf("Distribution %s is already serving %s\n", options.Distribution, id)
+		return
+	}
+
+	if r.planned(PlannedAction{
+		Action: "cloudfront:UpdateDistribution",
+		Path:   options.Distribution,
+		Detail: "origin path " + path,
+	}) {
+		return
+	}
+
+	body := append(append(append([]byte{}, config[:loc[0]]...), updated...), config[loc[1]:]...)
+
+	log.Printf("Pointing distribution %s at %s\n", options.Distribution, path)
+	r.cloudFrontRequest("PUT", options.Distribution+"/config", body, etag)
+
+	r.emit(Event{Event: "switched", Path: options.Distribution, Detail: "origin path " + path})
+}
+
+// copyVersioned copies the versioned files under the deploy id, as in atomic mode everything the site
+// uses must be found there.
+func (r *run) copyVersioned(options Options, id string, files []*FileRef) {
+
+	forever := fmt.Sprintf("public, max-age=%d", FOREVER)
+
+	for _, file := range files {
+		headers := file.Upload.Headers.merge(Headers{CacheControl: forever})
+
+		dest := joinPath(options.Dest, id, file.UploadedPath)
+		r.copyFile(file.UploadedPath, dest, file.Upload.ContentType, file.Upload.ContentEncoding, headers, id)
+
+		for _, variant := range file.Upload.Variants {
+			variantHeaders := variant.Headers.merge(Headers{CacheControl: forever})
+			r.copyFile(variant.Path, dest+BROTLI_EXT, variant.ContentType, variant.ContentEncoding, variantHeaders, id)
+		}
+	}
+}
+
+// atomicOptions returns the options the site's atomic deploys are served with, and false if it isn't
+// deployed atomically.  Status, prune and rollback can be run without --atomic, so unless it's given the
+// newest manifest decides, and the distribution it was deployed to is used if none is given.
+func atomicOptions(options Options, deploys []DeployInfo) (Options, bool) {
+	if !options.Atomic {
+		var newest *Manifest
+		for _, deploy := range deploys {
+			if deploy.Manifest != nil {
+				newest = deploy.Manifest
+				break
+			}
+		}
+
+		if newest == nil || !newest.Atomic {
+			return options, false
+		}
+
+		options.Atomic = true
+		if options.Distribution == "" {
+			options.Distribution = newest.Distribution
+			options.Origin = newest.Origin
+		}
+	}
+
+	if options.Distribution == "" {
+		panic(configError("The site is deployed atomically, specify the CloudFront distribution serving it with --distribution"))
+	}
+
+	return options, true
+}
+
+// atomicPageStatus is pageStatus for atomic deploys, where every page comes from the deploy the
+// distribution is pointed at.
+func (r *run) atomicPageStatus(options Options, deploys []DeployInfo) []PageStatus {
+	id := r.liveDeployId(options)
+
+	pages := make([]PageStatus, 0)
+	for _, deploy := range deploys {
+		if deploy.Id != id || deploy.Manifest == nil {
+			continue
+		}
+
+		for _, file := range deploy.Manifest.Files {
+			if file.Kind == MANIFEST_HTML {
+				pages = append(pages, PageStatus{Path: file.RemotePath, Id: id})
+			}
+		}
+	}
+
+	return pages
+}
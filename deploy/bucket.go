@@ -0,0 +1,203 @@
+package deploy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zackbloom/goamz/s3"
+)
+
+// S3Storage stores deploys in an S3 bucket, which is served by S3's website hosting or CloudFront.
+type S3Storage struct {
+	Bucket *s3.Bucket
+}
+
+func (s *S3Storage) Name() string {
+	return s.Bucket.Name
+}
+
+// notFound turns S3's 404s into ErrNotFound
+func notFound(err error) error {
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == 404 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func s3ACL(obj Object) s3.ACL {
+	if obj.Private {
+		return s3.Private
+	}
+	return s3.PublicRead
+}
+
+// s3Headers are the headers obj is uploaded with
+func s3Headers(obj Object) http.Header {
+	headers := make(http.Header)
+	headers.Set("x-amz-acl", string(s3ACL(obj)))
+
+	set := func(name, value string) {
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+	set("Content-Type", obj.ContentType)
+	set("Content-Encoding", obj.ContentEncoding)
+	set("Cache-Control", obj.CacheControl)
+	set("Content-Disposition", obj.ContentDisposition)
+	set("Content-Language", obj.ContentLanguage)
+	set("x-amz-website-redirect-location", obj.RedirectLocation)
+
+	if obj.MD5 != "" {
+		hash := must(hex.DecodeString(obj.MD5)).([]byte)
+		headers.Set("Content-MD5", base64.StdEncoding.EncodeToString(hash))
+	}
+
+	for k, v := range obj.Meta {
+		headers.Set("x-amz-meta-"+k, v)
+	}
+
+	return headers
+}
+
+func (s *S3Storage) Put(obj Object, body io.Reader) error {
+	_, err := s3Request(s.Bucket, "PUT", obj.Key, nil, s3Headers(obj), body, obj.Size)
+	return err
+}
+
+func (s *S3Storage) Copy(from string, obj Object) error {
+	headers := s3Headers(obj)
+	headers.Set("x-amz-copy-source", url.QueryEscape(joinPath(s.Bucket.Name, from)))
+	headers.Set("x-amz-metadata-directive", "REPLACE")
+
+	_, err := s3Request(s.Bucket, "PUT", obj.Key, nil, headers, nil, 0)
+	return err
+}
+
+// initMulti starts a multipart upload of obj, whose parts are then uploaded with goamz
+func initMulti(bucket *s3.Bucket, obj Object) (*s3.Multi, error) {
+	// The MD5 we have is of the whole file, each part is sent with its own
+	obj.MD5 = ""
+
+	data, err := s3Request(bucket, "POST", obj.Key, url.Values{"uploads": {""}}, s3Headers(obj), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	return &s3.Multi{Bucket: bucket, Key: obj.Key, UploadId: resp.UploadId}, nil
+}
+
+func (s *S3Storage) Head(key string) (*Object, error) {
+	resp, err := s.Bucket.Head(key, nil)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	resp.Body.Close()
+
+	header := resp.Header
+	obj := &Object{
+		Key:                key,
+		ETag:               strings.Trim(header.Get("ETag"), `"`),
+		ContentType:        header.Get("Content-Type"),
+		ContentEncoding:    header.Get("Content-Encoding"),
+		CacheControl:       header.Get("Cache-Control"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		ContentLanguage:    header.Get("Content-Language"),
+		RedirectLocation:   header.Get("X-Amz-Website-Redirect-Location"),
+		Meta:               make(map[string]string),
+	}
+
+	obj.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	obj.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) != 0 {
+			obj.Meta[strings.ToLower(name[len("X-Amz-Meta-"):])] = values[0]
+		}
+	}
+
+	return obj, nil
+}
+
+func (s *S3Storage) Get(key string) ([]byte, error) {
+	data, err := s.Bucket.Get(key)
+	return data, notFound(err)
+}
+
+// List follows the markers S3 gives us until the listing is no longer truncated.
+func (s *S3Storage) List(prefix, delim string) (objects []Object, prefixes []string, err error) {
+	objects = make([]Object, 0)
+	prefixes = make([]string, 0)
+
+	marker := ""
+	for {
+		list, err := s.Bucket.List(prefix, delim, marker, 1000)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, key := range list.Contents {
+			modified, _ := time.Parse(time.RFC3339, key.LastModified)
+
+			objects = append(objects, Object{
+				Key:          key.Key,
+				Size:         key.Size,
+				ETag:         strings.Trim(key.ETag, `"`),
+				LastModified: modified,
+			})
+		}
+		prefixes = append(prefixes, list.CommonPrefixes...)
+
+		if !list.IsTruncated {
+			return objects, prefixes, nil
+		}
+
+		marker = list.NextMarker
+		if marker == "" && len(list.CommonPrefixes) != 0 {
+			marker = list.CommonPrefixes[len(list.CommonPrefixes)-1]
+		}
+		if marker == "" {
+			return nil, nil, errors.New("S3 listing was truncated without a marker to continue from")
+		}
+	}
+}
+
+// Delete deletes the keys 1000 at a time, the most S3 allows in one request.
+func (s *S3Storage) Delete(keys []string) error {
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]s3.Object, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, s3.Object{Key: key})
+		}
+
+		err := s.Bucket.DelMulti(s3.Delete{
+			Quiet:   true,
+			Objects: objects,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+// Package deploy is everything the stout command does: deploying static sites to S3, rolling them back,
+// and creating the buckets, distributions and users they are served with.
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zackbloom/goamz/cloudfront"
+	"github.com/zackbloom/goamz/iam"
+	"github.com/zackbloom/goamz/route53"
+	"github.com/zackbloom/goamz/s3"
+)
+
+// Client runs deploys, rollbacks and the other commands with its own AWS sessions.  The sessions can be
+// replaced before it's used (with ones pointed at a test server, for example).  A Client can be used
+// by more than one goroutine at a time.
+type Client struct {
+	S3         *s3.S3
+	IAM        *iam.IAM
+	Route53    *route53.Route53
+	CloudFront *cloudfront.CloudFront
+
+	// Storage is where files are written, if it's nil they go to options.Local, or the bucket named by
+	// options.Bucket.  Deploys can be tested without AWS by setting it to a LocalStorage.
+	Storage Storage
+
+	// Progress is called with each event (a file being uploaded, copied or deleted, a retry and so on)
+	// as it happens.  It's called from many goroutines at once.
+	Progress func(Event)
+
+	// Confirm is asked before a rollback removes the pages added after the deploy it restores, unless
+	// options.Yes is set.  If it's nil those rollbacks fail instead.
+	Confirm func(message string) bool
+
+	// Messages receives the notes meant for people, like the DNS changes Create couldn't make itself.
+	// They are discarded if it's nil.
+	Messages io.Writer
+}
+
+// NewClient opens sessions with the credentials and region in options.  Local deploys don't use AWS, so
+// they don't get any.
+func NewClient(options Options) (client *Client, err error) {
+	defer recoverError(&err)
+
+	if options.Local != "" {
+		return &Client{}, nil
+	}
+
+	return &Client{
+		S3:         openS3(options.AWSKey, options.AWSSecret, options.AWSRegion, options.S3Host),
+		IAM:        openIAM(options.AWSKey, options.AWSSecret, options.AWSRegion),
+		Route53:    openRoute53(options.AWSKey, options.AWSSecret),
+		CloudFront: openCloudFront(options.AWSKey, options.AWSSecret),
+	}, nil
+}
+
+// run is the state of one command
+type run struct {
+	*Client
+	ctx context.Context
+
+	storage Storage
+
+	// Set if this is a dry run, see planned
+	plan *Plan
+
+	stats UploadStats
+}
+
+func (c *Client) start(ctx context.Context, options Options) *run {
+	r := &run{Client: c, ctx: ctx, storage: c.Storage}
+
+	if r.storage == nil {
+		switch {
+		case options.Local != "":
+			r.storage = &LocalStorage{Root: options.Local}
+		case options.Bucket != "" && c.S3 == nil:
+			panic(configError("The client has no S3 connection, use NewClient"))
+		case options.Bucket != "":
+			r.storage = &S3Storage{Bucket: c.S3.Bucket(options.Bucket)}
+		default:
+			panic(configError("You must specify a bucket"))
+		}
+	}
+
+	if options.DryRun {
+		r.plan = &Plan{
+			Actions: make([]PlannedAction, 0),
+		}
+	}
+	return r
+}
+
+func (r *run) emit(event Event) {
+	if r.Progress == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	r.Progress(event)
+}
+
+func (r *run) printf(format string, args ...interface{}) {
+	if r.Messages != nil {
+		fmt.Fprintf(r.Messages, format, args...)
+	}
+}
+
+// cancelled is true once the context is done, workers check it before starting on each file
+func (r *run) cancelled() bool {
+	return r.ctx.Err() != nil
+}
+
+// sleep waits for d, unless the command is cancelled first
+func (r *run) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.ctx.Done():
+		panic(r.ctx.Err())
+	}
+}
+
+// result is the Result each command's result embeds
+func (r *run) result(options Options, command string, start time.Time) Result {
+	result := Result{
+		Event:    "result",
+		Command:  command,
+		DryRun:   options.DryRun,
+		Duration: time.Since(start).Seconds(),
+	}
+
+	if r.plan != nil {
+		result.Plan = r.plan.Actions
+	}
+	return result
+}
@@ -0,0 +1,285 @@
+package deploy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Extensions of precompressed files our build might write next to the originals
+const (
+	GZIP_EXT   = ".gz"
+	BROTLI_EXT = ".br"
+)
+
+const DEFAULT_BROTLI_LEVEL = 11
+
+// Compression is how uploaded files are compressed.  Compressible files are always stored gzipped,
+// so every client can read them.  A brotli variant is stored next to each at <path>.br, which a CDN
+// can serve instead to clients which send `Accept-Encoding: br`.
+type Compression struct {
+	// A GzipLevel of 0 is gzip's default
+	GzipLevel   int
+	BrotliLevel int
+
+	// Generate brotli variants of files which don't have a precompressed .br file
+	Brotli bool
+
+	// Rules (globs or MIME types) for files which should or shouldn't be compressed, these take
+	// precedence over the defaults
+	Include []string
+	Exclude []string
+
+	// The MIME type rules are matched using these types
+	Types mimeTypes
+}
+
+// Formats which are already compressed, and would gain little (or even grow) from being gzipped
+var DEFAULT_NO_COMPRESS = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/font-woff",
+	"application/pdf",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+
+	// The system's MIME types don't always include these
+	"*.jpg", "*.jpeg", "*.png", "*.gif", "*.webp", "*.avif", "*.heic",
+	"*.mp4", "*.m4v", "*.webm", "*.mov", "*.ogg", "*.ogv", "*.mp3", "*.m4a", "*.aac", "*.flac", "*.opus",
+	"*.woff", "*.woff2",
+	"*.zip", "*.gz", "*.tgz", "*.bz2", "*.xz", "*.7z", "*.rar", "*.br", "*.zst", "*.jar", "*.pdf",
+}
+
+// Exceptions to DEFAULT_NO_COMPRESS, which compress well
+var DEFAULT_COMPRESS = []string{
+	"image/svg+xml",
+	"image/bmp",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"*.svg",
+	"*.bmp",
+	"*.ico",
+}
+
+// Compression rules which look like MIME types (image/* or application/json) are matched against
+// the content type of the file, anything else is a glob.
+var mimeRuleRe = regexp.MustCompile(`^(application|audio|font|image|model|text|video)/[^/]+$`)
+
+func splitRules(rules string) []string {
+	out := make([]string, 0)
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule != "" {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+func compression(o Options) Compression {
+	brotliLevel := DEFAULT_BROTLI_LEVEL
+	if o.BrotliLevel != nil {
+		brotliLevel = *o.BrotliLevel
+	}
+
+	return Compression{
+		Types:       newMimeTypes(o),
+		GzipLevel:   o.GzipLevel,
+		BrotliLevel: brotliLevel,
+		Brotli:      o.Brotli,
+		Include:     splitRules(o.Compress),
+		Exclude:     splitRules(o.NoCompress),
+	}
+}
+
+// matchesRule checks the file at path (relative to the dest) against a compression rule.  Globs
+// without a slash are matched against the name of the file, others against its whole path.  MIME
+// types are matched against contentType, the type the file is served with.
+func matchesRule(rule, file, contentType string) bool {
+	if mimeRuleRe.MatchString(rule) {
+		ok, _ := path.Match(rule, strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+		return ok
+	}
+
+	target := file
+	if !strings.Contains(rule, "/") {
+		target = path.Base(file)
+	}
+
+	ok, _ := path.Match(strings.TrimPrefix(rule, "./"), strings.TrimPrefix(target, "./"))
+	return ok
+}
+
+func matchesAny(rules []string, file, contentType string) bool {
+	for _, rule := range rules {
+		if matchesRule(rule, file, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldCompress decides if a file served as contentType should be gzipped.  Even if it should, it is
+// only stored compressed if that makes it smaller.
+func (c Compression) shouldCompress(file, contentType string) bool {
+	switch {
+	case matchesAny(c.Exclude, file, contentType):
+		return false
+	case matchesAny(c.Include, file, contentType):
+		return true
+	case matchesAny(DEFAULT_COMPRESS, file, contentType):
+		return true
+	case matchesAny(DEFAULT_NO_COMPRESS, file, contentType):
+		return false
+	}
+
+	return true
+}
+
+func (c Compression) gzipLevel() int {
+	if c.GzipLevel == 0 {
+		return gzip.DefaultCompression
+	}
+	return c.GzipLevel
+}
+
+// write writes the settings which decide how files are compressed (and the content types they're
+// matched by) to w, for the deploy id.  It's the settings which are hashed, not the compressors, so a
+// different version of the brotli command can compress identical files differently.
+func (c Compression) write(w io.Writer) {
+	fmt.Fprintf(w, "gzip %d\n", c.gzipLevel())
+	fmt.Fprintf(w, "brotli %t %d\n", c.Brotli, c.BrotliLevel)
+
+	for _, rule := range c.Include {
+		fmt.Fprintf(w, "compress %d:%s\n", len(rule), rule)
+	}
+	for _, rule := range c.Exclude {
+		fmt.Fprintf(w, "no-compress %d:%s\n", len(rule), rule)
+	}
+
+	exts := make([]string, 0, len(c.Types))
+	for ext := range c.Types {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		fmt.Fprintf(w, "type %d:%s %q\n", len(ext), ext, c.Types[ext])
+	}
+}
+
+func checkCompression(o Options) {
+	if o.GzipLevel < 0 || o.GzipLevel > gzip.BestCompression {
+		panic(configError("The gzip level must be between 1 and 9, or 0 for the default"))
+	}
+	if o.BrotliLevel != nil && (*o.BrotliLevel < 0 || *o.BrotliLevel > 11) {
+		panic(configError("The brotli level must be between 0 and 11"))
+	}
+
+	for _, rule := range append(splitRules(o.Compress), splitRules(o.NoCompress)...) {
+		if _, err := path.Match(rule, ""); err != nil {
+			panic(configError("Invalid compression rule %s: %s", rule, err))
+		}
+	}
+
+	if o.Brotli {
+		if _, err := exec.LookPath("brotli"); err != nil {
+			panic(configError("Generating brotli variants requires the brotli command line tool to be installed"))
+		}
+	}
+}
+
+// brotliWriter compresses everything written to it with the brotli command, writing the result to out.
+// The pure Go port (andybalholm/brotli) needs a newer Go than the one our vendored dependencies are
+// pinned to, so we shell out instead.
+type brotliWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newBrotliWriter(out *os.File, level int) *brotliWriter {
+	cmd := exec.Command("brotli", "-c", "-q", strconv.Itoa(level))
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	in := must(cmd.StdinPipe()).(io.WriteCloser)
+	panicIf(cmd.Start())
+
+	return &brotliWriter{in, cmd}
+}
+
+func (w *brotliWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.cmd.Wait()
+}
+
+// sidecarPath returns the path of the precompressed version of local with the extension ext, if there
+// is one and it is at least as new as the file itself.
+func sidecarPath(local, ext string) string {
+	path := local + ext
+
+	sidecar, err := os.Stat(path)
+	if err != nil || sidecar.IsDir() {
+		return ""
+	}
+
+	orig, err := os.Stat(local)
+	if err != nil {
+		return ""
+	}
+
+	if sidecar.ModTime().Before(orig.ModTime()) {
+		log.Printf("Ignoring %s, as it is older than %s\n", path, local)
+		return ""
+	}
+
+	return path
+}
+
+// findSidecars finds the precompressed versions of the file, if options.Precompressed says our build
+// writes them
+func findSidecars(options Options, file *FileRef) {
+	if !options.Precompressed {
+		return
+	}
+
+	file.GzipPath = sidecarPath(file.LocalPath, GZIP_EXT)
+	file.BrotliPath = sidecarPath(file.LocalPath, BROTLI_EXT)
+}
+
+// isSidecar is true for precompressed files next to their original, they are uploaded along with it
+// rather than on their own.  Without options.Precompressed they're deployed like any other file.
+func isSidecar(options Options, local string) bool {
+	if !options.Precompressed {
+		return false
+	}
+
+	for _, ext := range []string{GZIP_EXT, BROTLI_EXT} {
+		if strings.HasSuffix(local, ext) {
+			if _, err := os.Stat(strings.TrimSuffix(local, ext)); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,48 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var cssRefRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`),
+	regexp.MustCompile(`(?i)@import\s+(?:"([^"]*)"|'([^']*)')`),
+}
+
+func isCSSRef(ref string) bool {
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return false
+	}
+
+	return isLocal(ref)
+}
+
+func parseCSS(path string) (files []string) {
+	files = make([]string, 0)
+
+	data := must(ioutil.ReadFile(path)).([]byte)
+
+	replaceRefs(string(data), cssRefRes, func(ref string) string {
+		if isCSSRef(ref) {
+			files = append(files, ref)
+		}
+		return ref
+	})
+
+	return
+}
+
+func renderCSS(file *FileRef) string {
+	data := must(ioutil.ReadFile(file.LocalPath)).([]byte)
+
+	return replaceRefs(string(data), cssRefRes, func(ref string) string {
+		for _, dep := range file.Deps {
+			if dep.InstPath == ref {
+				return formatHref(dep.File.UploadedPath) + refSuffix(ref)
+			}
+		}
+		return ref
+	})
+}
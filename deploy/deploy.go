@@ -0,0 +1,1427 @@
+package deploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenk/backoff"
+	"golang.org/x/net/html"
+
+	"log"
+
+	"github.com/zackbloom/goamz/s3"
+)
+
+const (
+	SCRIPT = iota
+	STYLE
+)
+
+const UPLOAD_WORKERS = 20
+
+// S3 allows at most 10,000 parts per upload, each (but the last) at least 5 MB
+const (
+	MULTIPART_PART_SIZE = 16 * 1024 * 1024
+	MULTIPART_MAX_PARTS = 10000
+)
+
+// The metadata key we store the MD5 of each file's contents in
+const MD5_META = "stout-md5"
+
+func sha256File(path string) []byte {
+	hash := sha256.New()
+
+	ref := must(os.Open(path)).(*os.File)
+	defer ref.Close()
+
+	must(io.Copy(hash, ref))
+
+	return hash.Sum(nil)
+}
+
+// deployId hashes everything which ends up in a deploy: the path and contents of every file, the
+// paths the versioned files were uploaded to, the rendered html and the options which change where
+// things are written or how they're compressed and served.  The entries are sorted, so the same input
+// always produces the same id, whatever machine it's run on.
+func deployId(options Options, files []*FileRef, versioned []*FileRef, htmlFiles []HTMLFile, redirects []Redirect) string {
+	entries := make([]string, 0, len(files)+len(versioned)+len(htmlFiles))
+
+	entry := func(kind, path string, sum []byte) {
+		entries = append(entries, fmt.Sprintf("%s %d:%s %x\n", kind, len(path), path, sum))
+	}
+
+	sidecars := func(path string, file *FileRef) {
+		if file.GzipPath != "" {
+			entry("gzip", path, sha256File(file.GzipPath))
+		}
+		if file.BrotliPath != "" {
+			entry("brotli", path, sha256File(file.BrotliPath))
+		}
+	}
+
+	for _, file := range files {
+		entry("file", file.RemotePath, sha256File(file.LocalPath))
+		sidecars(file.RemotePath, file)
+	}
+	for _, file := range versioned {
+		entry("versioned", file.UploadedPath, sha256File(file.LocalPath))
+		sidecars(file.UploadedPath, file)
+	}
+	for _, file := range htmlFiles {
+		sum := sha256.Sum256([]byte(file.Rendered))
+		entry("html", file.File.RemotePath, sum[:])
+	}
+	for _, redirect := range redirects {
+		entry("redirect", redirect.From, []byte(fmt.Sprintf("%d %t %s", redirect.Status, redirect.Force, redirect.To)))
+	}
+
+	sort.Strings(entries)
+
+	hash := sha256.New()
+	// Spellings of the same dest (./, / and an empty string, or blog and blog/) give the same id
+	dest := destPrefix(options)
+	fmt.Fprintf(hash, "dest %d:%s\n", len(dest), dest)
+	fmt.Fprintf(hash, "version-all %t\n", options.VersionAll)
+	fmt.Fprintf(hash, "atomic %t\n", options.Atomic)
+	compression(options).write(hash)
+	options.Headers.write(hash)
+	for _, e := range entries {
+		io.WriteString(hash, e)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// getRef returns the git commit being deployed, or an empty string if it can't be determined
+// (git isn't installed, or we're not in a repository).
+func getRef() string {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return ""
+	}
+
+	cmd := exec.Command(gitPath, "rev-parse", "--verify", "HEAD")
+
+	out := bytes.Buffer{}
+	cmd.Stdout = &out
+	if cmd.Run() != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out.Bytes()))
+}
+
+type UploadFileRequest struct {
+	Reader       io.Reader
+	Path         string
+	Dest         string
+	IncludeHash  bool
+	CacheSeconds int
+
+	// Used in place of the hash of the contents when IncludeHash is set
+	HashPrefix string
+
+	// Private files (the manifest) aren't served to anyone
+	Private bool
+
+	// Files larger than this many bytes are uploaded in parts, zero disables multipart uploads
+	MultipartThreshold int64
+
+	// Precompressed versions of the file, which are uploaded rather than compressing it ourselves
+	GzipPath   string
+	BrotliPath string
+
+	Compression Compression
+
+	// Rules for extra headers, which are matched against Path
+	Headers HeaderRules
+}
+
+type UploadedFile struct {
+	Path            string
+	Hash            string
+	Size            int64
+	ContentType     string
+	ContentEncoding string
+	CacheSeconds    int
+
+	// Headers set by the header rules, these are also set on the live copies of the file
+	Headers Headers
+
+	// The object in S3 already had these contents and headers, so it wasn't uploaded again
+	Skipped bool
+
+	// Differently encoded versions of the file stored alongside it (<path>.br)
+	Variants []UploadedFile
+}
+
+type UploadStats struct {
+	sync.Mutex
+	Uploaded      int
+	UploadedBytes int64
+	Skipped       int
+	SkippedBytes  int64
+	Activated     int
+}
+
+func (s *UploadStats) add(file UploadedFile) {
+	s.Lock()
+	defer s.Unlock()
+
+	if file.Skipped {
+		s.Skipped++
+		s.SkippedBytes += file.Size
+	} else {
+		s.Uploaded++
+		s.UploadedBytes += file.Size
+	}
+}
+
+func (s *UploadStats) activated() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.Activated++
+}
+
+// isUnchanged checks if the object at obj.Key already has the contents and headers we're about to upload.
+// The contents are compared using the MD5 we store in the object's metadata, or for objects uploaded
+// before we did that, its ETag (which is the MD5 of the contents for objects not uploaded in parts).
+func (r *run) isUnchanged(obj Object) bool {
+	remote, err := r.storage.Head(obj.Key)
+	if err != nil {
+		return false
+	}
+
+	remoteHash := remote.Meta[MD5_META]
+	if remoteHash == "" {
+		remoteHash = remote.ETag
+	}
+
+	for k, v := range obj.Meta {
+		if k != MD5_META && remote.Meta[k] != v {
+			return false
+		}
+	}
+
+	return remoteHash == obj.MD5 &&
+		remote.ContentDisposition == obj.ContentDisposition &&
+		remote.ContentLanguage == obj.ContentLanguage &&
+		remote.ContentType == obj.ContentType &&
+		remote.ContentEncoding == obj.ContentEncoding &&
+		remote.CacheControl == obj.CacheControl
+}
+
+// contextBackOff stops retrying once the context is done
+type contextBackOff struct {
+	backoff.BackOff
+	ctx context.Context
+}
+
+func (b contextBackOff) NextBackOff() time.Duration {
+	if b.ctx.Err() != nil {
+		return backoff.Stop
+	}
+	return b.BackOff.NextBackOff()
+}
+
+func (r *run) retry(op func() error, action string) error {
+	return r.retryContext(r.ctx, op, action)
+}
+
+// retryContext is retry, stopping when ctx is done rather than the context of the run
+func (r *run) retryContext(ctx context.Context, op func() error, action string) error {
+	back := backoff.NewExponentialBackOff()
+	back.MaxElapsedTime = 30 * time.Second
+
+	attempt := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return op()
+	}
+
+	return backoff.RetryNotify(attempt, contextBackOff{back, ctx}, func(err error, next time.Duration) {
+		log.Println("Error", action, err, "retrying in", next)
+
+		r.emit(Event{
+			Event:  "retry",
+			Detail: action,
+			Error:  err.Error(),
+		})
+	})
+}
+
+func tempFile() *os.File {
+	return must(ioutil.TempFile("", "stout-")).(*os.File)
+}
+
+func removeTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// hashFile returns the MD5 and size of the contents of file.
+func hashFile(file *os.File) (hash []byte, size int64) {
+	must(file.Seek(0, os.SEEK_SET))
+
+	md5Hash := md5.New()
+	size = must(io.Copy(md5Hash, file)).(int64)
+
+	return md5Hash.Sum(nil), size
+}
+
+func copyLocal(w io.Writer, path string) {
+	file := must(os.Open(path)).(*os.File)
+	defer file.Close()
+
+	must(io.Copy(w, file))
+}
+
+// uploadFile compresses and uploads the contents of req.Reader, unless S3 already has them.
+func (r *run) uploadFile(req UploadFileRequest) (uploaded UploadedFile, err error) {
+	defer recoverError(&err)
+
+	// The contents are streamed to temporary files, rather than being held in memory, as they can be
+	// very large.
+	raw := tempFile()
+	defer removeTemp(raw)
+
+	rawSize := must(io.Copy(raw, req.Reader)).(int64)
+
+	body := raw
+	encoding := ""
+
+	// The rules are matched against the type the file will be served with, which may have been
+	// sniffed from its contents
+	contentType := detectContentType(req.Compression.Types, req.Path, raw)
+	headers := req.Headers.match(req.Path, contentType)
+	if headers.ContentType != "" {
+		contentType = headers.ContentType
+	}
+
+	if req.Compression.shouldCompress(req.Path, contentType) {
+		gz := tempFile()
+		defer removeTemp(gz)
+
+		if req.GzipPath != "" {
+			copyLocal(gz, req.GzipPath)
+		} else {
+			must(raw.Seek(0, os.SEEK_SET))
+
+			gzWriter := must(gzip.NewWriterLevel(gz, req.Compression.gzipLevel())).(*gzip.Writer)
+			must(io.Copy(gzWriter, raw))
+			panicIf(gzWriter.Close())
+		}
+
+		if must(gz.Seek(0, os.SEEK_CUR)).(int64) < rawSize {
+			body = gz
+			encoding = "gzip"
+		} else {
+			log.Printf("Not compressing %s, as gzip doesn't make it any smaller\n", req.Path)
+		}
+	}
+
+	var brotli *os.File
+	if encoding != "" && (req.BrotliPath != "" || req.Compression.Brotli) {
+		brotli = tempFile()
+		defer removeTemp(brotli)
+
+		if req.BrotliPath != "" {
+			copyLocal(brotli, req.BrotliPath)
+		} else {
+			must(raw.Seek(0, os.SEEK_SET))
+
+			brWriter := newBrotliWriter(brotli, req.Compression.BrotliLevel)
+			must(io.Copy(brWriter, raw))
+			panicIf(brWriter.Close())
+		}
+	}
+
+	hash, size := hashFile(body)
+	hashPrefix := fmt.Sprintf("%x", hash)[:12]
+
+	dest := req.Path
+	if req.IncludeHash && req.HashPrefix != "" {
+		dest = req.HashPrefix + "_" + dest
+	} else if req.IncludeHash {
+		dest = hashPrefix + "_" + dest
+	}
+	dest = filepath.Join(req.Dest, dest)
+
+	uploaded = UploadedFile{
+		Path:            dest,
+		Hash:            fmt.Sprintf("%x", hash),
+		Size:            size,
+		ContentType:     contentType,
+		ContentEncoding: encoding,
+		CacheSeconds:    req.CacheSeconds,
+		Headers:         headers,
+	}
+
+	uploaded = r.putFile(req, body, uploaded)
+
+	if brotli != nil {
+		brHash, brSize := hashFile(brotli)
+		if brSize >= rawSize {
+			return uploaded, nil
+		}
+
+		uploaded.Variants = append(uploaded.Variants, r.putFile(req, brotli, UploadedFile{
+			Path:            dest + BROTLI_EXT,
+			Hash:            fmt.Sprintf("%x", brHash),
+			Size:            brSize,
+			ContentType:     contentType,
+			ContentEncoding: "br",
+			CacheSeconds:    req.CacheSeconds,
+			Headers:         headers,
+		}))
+	}
+
+	return uploaded, nil
+}
+
+// putFile uploads the contents of file to uploaded.Path, unless the object there already has them.
+func (r *run) putFile(req UploadFileRequest, file *os.File, uploaded UploadedFile) UploadedFile {
+	dest := uploaded.Path
+	hashPrefix := uploaded.Hash[:12]
+
+	scope := "public"
+	if req.Private {
+		scope = "private"
+	}
+
+	obj := Object{
+		Key:             dest,
+		Size:            uploaded.Size,
+		MD5:             uploaded.Hash,
+		ContentType:     uploaded.ContentType,
+		ContentEncoding: uploaded.ContentEncoding,
+		CacheControl:    fmt.Sprintf("%s, max-age=%d", scope, uploaded.CacheSeconds),
+		Private:         req.Private,
+
+		// The ETag of a multipart upload isn't the MD5 of the contents, so we keep it ourselves
+		Meta: map[string]string{
+			MD5_META: uploaded.Hash,
+		},
+	}
+
+	uploaded.Headers.apply(&obj)
+
+	if r.isUnchanged(obj) {
+		log.Printf("Skipping %s in %s, it hasn't changed (%s)\n", dest, r.storage.Name(), hashPrefix)
+
+		uploaded.Skipped = true
+		r.stats.add(uploaded)
+		r.emitUpload("skipped", uploaded)
+		return uploaded
+	}
+
+	if r.planned(PlannedAction{
+		Action:          "s3:PutObject",
+		Path:            dest,
+		Size:            uploaded.Size,
+		ContentType:     uploaded.ContentType,
+		ContentEncoding: uploaded.ContentEncoding,
+		CacheControl:    obj.CacheControl,
+	}) {
+		return uploaded
+	}
+
+	log.Printf("Uploading to %s in %s (%s) [%s]\n", dest, r.storage.Name(), hashPrefix, obj.CacheControl)
+
+	// Other storage has no need to split up large files
+	bucket, isS3 := r.storage.(*S3Storage)
+	if isS3 && req.MultipartThreshold > 0 && uploaded.Size > req.MultipartThreshold {
+		r.putMultipart(bucket.Bucket, obj, file)
+	} else {
+		op := func() error {
+			// We need to rewind the file each time, as we might be doing this more than once (if it fails)
+			_, err := file.Seek(0, os.SEEK_SET)
+			if err != nil {
+				return err
+			}
+
+			return r.storage.Put(obj, file)
+		}
+
+		panicIf(r.retry(op, "uploading"))
+	}
+
+	r.stats.add(uploaded)
+	r.emitUpload("uploaded", uploaded)
+	return uploaded
+}
+
+func (r *run) emitUpload(event string, uploaded UploadedFile) {
+	r.emit(Event{
+		Event:           event,
+		Path:            uploaded.Path,
+		Size:            uploaded.Size,
+		Hash:            uploaded.Hash,
+		ContentType:     uploaded.ContentType,
+		ContentEncoding: uploaded.ContentEncoding,
+	})
+}
+
+// putMultipart uploads the file in parts, retrying each part individually.
+func (r *run) putMultipart(bucket *s3.Bucket, obj Object, file *os.File) {
+	dest, size := obj.Key, obj.Size
+
+	partSize := int64(MULTIPART_PART_SIZE)
+	if size/partSize >= MULTIPART_MAX_PARTS {
+		partSize = size/(MULTIPART_MAX_PARTS-1) + 1
+	}
+
+	var multi *s3.Multi
+	panicIf(r.retry(func() (err error) {
+		multi, err = initMulti(bucket, obj)
+		return
+	}, "starting upload of"))
+
+	parts := make([]s3.Part, 0, size/partSize+1)
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		section := io.NewSectionReader(file, offset, partSize)
+
+		var part s3.Part
+		err := r.retry(func() (err error) {
+			part, err = multi.PutPart(n, section)
+			return
+		}, fmt.Sprintf("uploading part %d of", n))
+
+		if err != nil {
+			multi.Abort()
+			panic(err)
+		}
+
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+		log.Printf("Uploaded part %d of %s (%d of %d bytes)\n", n, dest, end, size)
+
+		parts = append(parts, part)
+	}
+
+	err := r.retry(func() error {
+		return multi.Complete(parts)
+	}, "completing upload of")
+
+	if err != nil {
+		multi.Abort()
+		panic(err)
+	}
+}
+
+type FileRef struct {
+	LocalPath    string
+	RemotePath   string
+	UploadedPath string
+
+	// References inside the file (CSS url()s for example) which must be rewritten to point
+	// to the uploaded paths of their files before this file can be uploaded.
+	Deps []FileInst
+
+	// Loaded as an ES module, meaning its imports are included in Deps
+	Module bool
+
+	// Precompressed versions of the file our build wrote next to it
+	GzipPath   string
+	BrotliPath string
+
+	// Set if the file is part of a circular dependency, so can't be named by the hash of its rewritten
+	// contents
+	HashPrefix string
+
+	// Filled in after the deploy:
+	Upload UploadedFile
+}
+
+type FileInst struct {
+	File     *FileRef
+	InstPath string
+}
+
+func (r *run) writeFiles(options Options, id string, includeHash bool, files chan *FileRef, errs *fileErrors) {
+	for file := range files {
+		if err := r.writeFile(options, id, includeHash, file); err != nil {
+			log.Printf("Error uploading %s: %s\n", file.LocalPath, err)
+			errs.add(file.LocalPath, err)
+		}
+	}
+}
+
+func (r *run) writeFile(options Options, id string, includeHash bool, file *FileRef) (err error) {
+	defer recoverError(&err)
+
+	// Files which are stored under a deploy id are never modified once written, so they
+	// can be cached just like hashed files.
+	dest := options.Dest
+	if id != "" {
+		dest = joinPath(options.Dest, id)
+	}
+
+	handle, err := os.Open(file.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	var reader io.Reader = handle
+	gzipPath, brotliPath := file.GzipPath, file.BrotliPath
+	if len(file.Deps) != 0 {
+		switch filepath.Ext(file.LocalPath) {
+		case ".css":
+			reader = strings.NewReader(renderCSS(file))
+		case ".js", ".mjs":
+			reader = strings.NewReader(renderJS(file))
+		}
+
+		// The precompressed files don't have the rewritten references
+		gzipPath, brotliPath = "", ""
+	}
+
+	var ttl int
+	ttl = FOREVER
+	if !includeHash && (id == "" || options.Atomic) {
+		// Files under the deploy id are served directly in atomic mode, so can't be cached forever
+		ttl = LIMITED
+	}
+
+	remote := file.RemotePath
+	if strings.HasPrefix(remote, "/") {
+		remote = remote[1:]
+	}
+	partialPath, err := filepath.Rel(options.Dest, remote)
+	if err != nil {
+		return err
+	}
+
+	upload, err := r.uploadFile(UploadFileRequest{
+		Reader:       reader,
+		Path:         partialPath,
+		Dest:         dest,
+		IncludeHash:  includeHash,
+		HashPrefix:   file.HashPrefix,
+		CacheSeconds: ttl,
+
+		MultipartThreshold: multipartThreshold(options),
+
+		GzipPath:    gzipPath,
+		BrotliPath:  brotliPath,
+		Compression: compression(options),
+		Headers:     options.Headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	(*file).Upload = upload
+	(*file).UploadedPath = file.Upload.Path
+
+	return nil
+}
+
+// deployFiles uploads files to their remote paths.  If includeHash is set they are prefixed with
+// the hash of their contents, if an id is provided they are stored under that deploy id and must
+// later be activated with activateFiles.  Every file is attempted, any which fail are returned as a
+// PartialError.
+func (r *run) deployFiles(options Options, id string, includeHash bool, files []*FileRef) error {
+	for _, file := range files {
+		if !includeHash && id == "" && strings.HasSuffix(file.RemotePath, ".html") {
+			return configError("Cowardly refusing to deploy an html file (%s) without versioning.", file.RemotePath)
+		}
+	}
+
+	ch := make(chan *FileRef)
+	errs := r.newFileErrors()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < UPLOAD_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			r.writeFiles(options, id, includeHash, ch, errs)
+			wg.Done()
+		}()
+	}
+
+	for _, file := range files {
+		if r.cancelled() {
+			break
+		}
+		ch <- file
+	}
+
+	close(ch)
+
+	wg.Wait()
+
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	return errs.err("upload", len(files))
+}
+
+// deployGraph uploads versioned files which may depend on one another.  Files are uploaded in rounds,
+// each only including files whose dependencies have already been uploaded, so their references
+// can be rewritten to the hashed paths.  Files which import one another can't wait for each other, so
+// they're named by a hash of all of them instead (see versionCycle).
+func (r *run) deployGraph(options Options, files []*FileRef) error {
+	remaining := files
+
+	for len(remaining) != 0 {
+		ready := make([]*FileRef, 0)
+		waiting := make([]*FileRef, 0)
+
+		for _, file := range remaining {
+			uploaded := true
+			for _, dep := range file.Deps {
+				if dep.File.UploadedPath == "" {
+					uploaded = false
+					break
+				}
+			}
+
+			if uploaded {
+				ready = append(ready, file)
+			} else {
+				waiting = append(waiting, file)
+			}
+		}
+
+		if len(ready) == 0 {
+			log.Printf("Warning: %d files (including %s) have a circular dependency, they will be versioned together\n", len(waiting), waiting[0].LocalPath)
+
+			versionCycle(options, waiting)
+			ready, waiting = waiting, nil
+		}
+
+		// The files waiting on these can't be uploaded if any of them failed
+		if err := r.deployFiles(options, "", true, ready); err != nil {
+			return err
+		}
+
+		remaining = waiting
+	}
+
+	return nil
+}
+
+// versionCycle names files which are waiting on one another by the hash of all of their contents and
+// the paths of everything else they point to, so their paths are known before any of them are
+// rewritten.  Changing any of them changes the paths of all of them.
+func versionCycle(options Options, files []*FileRef) {
+	sorted := make([]*FileRef, len(files))
+	copy(sorted, files)
+	sort.Sort(filesByRemotePath(sorted))
+
+	hash := sha256.New()
+	for _, file := range sorted {
+		fmt.Fprintf(hash, "file %s %x\n", file.RemotePath, sha256File(file.LocalPath))
+
+		for _, dep := range file.Deps {
+			fmt.Fprintf(hash, "dep %s %s %s\n", dep.InstPath, dep.File.RemotePath, dep.File.UploadedPath)
+		}
+	}
+	prefix := fmt.Sprintf("%x", hash.Sum(nil))[:12]
+
+	for _, file := range sorted {
+		remote := strings.TrimPrefix(file.RemotePath, "/")
+
+		file.HashPrefix = prefix
+		file.UploadedPath = filepath.Join(options.Dest, prefix+"_"+mustString(filepath.Rel(options.Dest, remote)))
+	}
+}
+
+type filesByRemotePath []*FileRef
+
+func (f filesByRemotePath) Len() int           { return len(f) }
+func (f filesByRemotePath) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f filesByRemotePath) Less(i, j int) bool { return f[i].RemotePath < f[j].RemotePath }
+
+// activateFiles copies files which were stored under a deploy id to their unprefixed paths.
+func (r *run) activateFiles(options Options, id string, files []*FileRef) error {
+	ch := make(chan *FileRef)
+	errs := r.newFileErrors()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < UPLOAD_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for file := range ch {
+				if err := r.activateFile(id, file); err != nil {
+					log.Printf("Error copying %s: %s\n", file.UploadedPath, err)
+					errs.add(file.UploadedPath, err)
+				}
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if r.cancelled() {
+			break
+		}
+		ch <- file
+	}
+
+	close(ch)
+
+	wg.Wait()
+
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	return errs.err("copy", len(files))
+}
+
+func (r *run) activateFile(id string, file *FileRef) (err error) {
+	defer recoverError(&err)
+
+	remote := strings.TrimPrefix(file.RemotePath, "/")
+
+	log.Println("Copying", file.UploadedPath, "to", remote)
+	r.copyFile(file.UploadedPath, remote, file.Upload.ContentType, file.Upload.ContentEncoding, file.Upload.Headers, id)
+
+	for _, variant := range file.Upload.Variants {
+		r.copyFile(variant.Path, remote+BROTLI_EXT, variant.ContentType, variant.ContentEncoding, variant.Headers, id)
+	}
+
+	r.stats.activated()
+	r.emit(Event{Event: "activated", Path: remote, From: file.UploadedPath})
+	return nil
+}
+
+func addFiles(form uint8, parent *html.Node, files []string) {
+	for _, file := range files {
+		node := html.Node{
+			Type: html.ElementNode,
+		}
+		switch form {
+		case SCRIPT:
+			node.Data = "script"
+			node.Attr = []html.Attribute{
+				html.Attribute{
+					Key: "src",
+					Val: file,
+				},
+			}
+
+		case STYLE:
+			node.Data = "link"
+			node.Attr = []html.Attribute{
+				html.Attribute{
+					Key: "rel",
+					Val: "stylesheet",
+				},
+				html.Attribute{
+					Key: "href",
+					Val: file,
+				},
+			}
+		default:
+			panic("Type not understood")
+		}
+
+		parent.AppendChild(&node)
+	}
+}
+
+func isLocal(href string) bool {
+	parsed := must(url.Parse(href)).(*url.URL)
+	return parsed.Host == "" && parsed.Scheme == ""
+}
+
+// replaceRefs calls fn with the first matched group of every match of res in data, replacing the
+// reference with the value it returns.
+func replaceRefs(data string, res []*regexp.Regexp, fn func(ref string) string) string {
+	for _, re := range res {
+		data = re.ReplaceAllStringFunc(data, func(match string) string {
+			parts := re.FindStringSubmatchIndex(match)
+
+			for i := 2; i < len(parts); i += 2 {
+				if parts[i] == -1 {
+					continue
+				}
+
+				ref := match[parts[i]:parts[i+1]]
+				return match[:parts[i]] + fn(ref) + match[parts[i+1]:]
+			}
+
+			return match
+		})
+	}
+
+	return data
+}
+
+// refPath strips the query string and fragment from a reference, leaving the path of the file.
+func refPath(ref string) string {
+	if i := strings.IndexAny(ref, "?#"); i != -1 {
+		return ref[:i]
+	}
+	return ref
+}
+
+// refSuffix is the query string and fragment refPath removes.
+func refSuffix(ref string) string {
+	return ref[len(refPath(ref)):]
+}
+
+func formatHref(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// uploadHTML uploads the rendered html to its path under the deploy id, it isn't live until activateHTML is called.
+func (r *run) uploadHTML(options Options, id string, file *HTMLFile) (err error) {
+	defer recoverError(&err)
+
+	internalPath, err := filepath.Rel(options.Root, file.File.LocalPath)
+	if err != nil {
+		return err
+	}
+
+	// In atomic mode the html is served from under the deploy id, so it can't be cached forever
+	ttl := FOREVER
+	if options.Atomic {
+		ttl = LIMITED
+	}
+
+	upload, err := r.uploadFile(UploadFileRequest{
+		Reader:       strings.NewReader(file.Rendered),
+		Path:         internalPath,
+		Dest:         joinPath(options.Dest, id),
+		IncludeHash:  false,
+		CacheSeconds: ttl,
+		Compression:  compression(options),
+		Headers:      options.Headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	file.File.Upload = upload
+	file.File.UploadedPath = file.File.Upload.Path
+	return nil
+}
+
+func (r *run) activateHTML(options Options, id string, file HTMLFile) (err error) {
+	defer recoverError(&err)
+
+	internalPath, err := filepath.Rel(options.Root, file.File.LocalPath)
+	if err != nil {
+		return err
+	}
+
+	curPath := joinPath(options.Dest, internalPath)
+
+	log.Println("Copying", file.File.UploadedPath, "to", curPath)
+	r.copyFile(file.File.UploadedPath, curPath, file.File.Upload.ContentType, file.File.Upload.ContentEncoding, file.File.Upload.Headers, id)
+
+	for _, variant := range file.File.Upload.Variants {
+		r.copyFile(variant.Path, curPath+BROTLI_EXT, variant.ContentType, variant.ContentEncoding, variant.Headers, id)
+	}
+
+	r.stats.activated()
+	r.emit(Event{Event: "activated", Path: curPath, From: file.File.UploadedPath})
+	return nil
+}
+
+func expandFiles(root string, glob string) []string {
+	out := make([]string, 0)
+	cases := strings.Split(glob, ",")
+
+	for _, pattern := range cases {
+		if strings.HasPrefix(pattern, "-/") {
+			pattern = pattern[2:]
+		} else {
+			pattern = joinPath(root, pattern)
+		}
+
+		list := must(filepath.Glob(pattern)).([]string)
+
+		for _, file := range list {
+			info := must(os.Stat(file)).(os.FileInfo)
+
+			if info.IsDir() {
+				filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+					panicIf(err)
+
+					if !info.IsDir() {
+						out = append(out, path)
+					}
+
+					return nil
+				})
+			} else {
+				out = append(out, file)
+			}
+		}
+	}
+	return out
+}
+
+func listFiles(options Options) []*FileRef {
+	filePaths := expandFiles(options.Root, options.Files)
+
+	files := make([]*FileRef, 0, len(filePaths))
+	for _, path := range filePaths {
+		if isSidecar(options, path) {
+			continue
+		}
+
+		remotePath := joinPath(options.Dest, mustString(filepath.Rel(options.Root, path)))
+
+		for strings.HasPrefix(remotePath, "../") {
+			remotePath = remotePath[3:]
+		}
+
+		file := &FileRef{
+			LocalPath:  path,
+			RemotePath: remotePath,
+		}
+		findSidecars(options, file)
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+func ignoreFiles(full []*FileRef, rem []*FileRef) []*FileRef {
+	out := make([]*FileRef, 0, len(full))
+
+	for _, file := range full {
+		ignore := false
+		path := filepath.Clean(file.LocalPath)
+
+		for _, remFile := range rem {
+			if filepath.Clean(remFile.LocalPath) == path {
+				ignore = true
+				break
+			}
+		}
+
+		if !ignore {
+			out = append(out, file)
+		}
+	}
+
+	return out
+}
+
+func extractFileList(options Options, pattern string) (files []string) {
+	files = make([]string, 0)
+
+	parts := strings.Split(pattern, ",")
+
+	for _, part := range parts {
+		matches, err := filepath.Glob(joinPath(options.Root, part))
+		if err != nil {
+			panic(err)
+		}
+		if matches == nil {
+			panic(configError("Pattern %s did not match any files", part))
+		}
+
+		files = append(files, matches...)
+	}
+
+	return files
+}
+
+func filesWithExtension(files []*FileRef, ext string) (outFiles []*FileRef) {
+	outFiles = make([]*FileRef, 0)
+	for _, file := range files {
+		if filepath.Ext(file.LocalPath) == ext {
+			outFiles = append(outFiles, file)
+		}
+	}
+
+	return
+}
+
+// includeFile adds the file at local to the set of versioned files, scanning it for references of
+// its own the first time it is seen.  JavaScript files are only scanned for imports when they are
+// loaded as ES modules.
+func includeFile(options Options, inclFiles map[string]*FileRef, local, remote string, module bool) *FileRef {
+	ref, ok := inclFiles[local]
+	if !ok {
+		ref = &FileRef{
+			LocalPath:  local,
+			RemotePath: remote,
+
+			// Filled in after the deploy:
+			UploadedPath: "",
+		}
+
+		inclFiles[local] = ref
+		findSidecars(options, ref)
+
+		if filepath.Ext(local) == ".css" {
+			addDeps(options, inclFiles, ref, parseCSS(local), false)
+		}
+	}
+
+	if module && !ref.Module {
+		ref.Module = true
+
+		switch filepath.Ext(local) {
+		case ".js", ".mjs":
+			// Anything a module imports is also a module
+			addDeps(options, inclFiles, ref, parseJS(local), true)
+		}
+	}
+
+	return ref
+}
+
+func addDeps(options Options, inclFiles map[string]*FileRef, ref *FileRef, paths []string, module bool) {
+	for _, path := range paths {
+		var depLocal, depRemote string
+		if strings.HasPrefix(path, "/") {
+			depLocal = joinPath(options.Root, refPath(path))
+			depRemote = joinPath(options.Dest, refPath(path))
+		} else {
+			depLocal = joinPath(filepath.Dir(ref.LocalPath), refPath(path))
+			depRemote = joinPath(filepath.Dir(ref.RemotePath), refPath(path))
+		}
+
+		for strings.HasPrefix(depRemote, "../") {
+			depRemote = depRemote[3:]
+		}
+
+		if _, err := os.Stat(depLocal); err != nil {
+			log.Printf("Not versioning %s referenced in %s, as it could not be found locally\n", path, ref.LocalPath)
+			continue
+		}
+
+		ref.Deps = append(ref.Deps, FileInst{
+			File:     includeFile(options, inclFiles, depLocal, depRemote, module),
+			InstPath: path,
+		})
+	}
+}
+
+type HTMLFile struct {
+	File FileRef
+	Deps []FileInst
+	Base string
+
+	// The html with its references rewritten to the versioned paths
+	Rendered string
+}
+
+func (f HTMLFile) GetLocalPath() string {
+	return f.File.LocalPath
+}
+
+// Deploy uploads the site and makes it live.  The error is an *Error, a *PartialError if some of the
+// files couldn't be uploaded or copied, the context's error if it's cancelled, or an error from S3 or
+// CloudFront.
+func (c *Client) Deploy(ctx context.Context, options Options) (result *DeployResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	checkCompression(options)
+	checkHeaders(options)
+	checkMimeTypes(options)
+	checkAtomic(options)
+
+	// Fail before uploading anything if the site is locked
+	r.checkLock(options)
+
+	files := listFiles(options)
+
+	headerBlocks, redirects, hasRedirects := readNetlifyFiles(options)
+	files = ignoreNetlifyFiles(options, files)
+
+	deployed := make(map[string]bool)
+	for _, file := range files {
+		deployed[strings.TrimPrefix(file.RemotePath, "/")] = true
+	}
+	redirectObjects, routingRules := translateRedirects(options, redirects, deployed)
+
+	htmlFileRefs := filesWithExtension(files, ".html")
+	otherFiles := ignoreFiles(files, htmlFileRefs)
+	var htmlFiles []HTMLFile
+	var inclFileList []*FileRef
+
+	if len(htmlFileRefs) == 0 {
+		log.Println("No HTML files found")
+	} else {
+		inclFiles := make(map[string]*FileRef)
+		htmlFiles = make([]HTMLFile, len(htmlFileRefs))
+		for i, file := range htmlFileRefs {
+			dir := filepath.Dir(file.LocalPath)
+
+			rel, err := filepath.Rel(options.Root, dir)
+			if err != nil {
+				panic(err)
+			}
+
+			deps, base := parseHTML(options, file.LocalPath)
+
+			if strings.HasPrefix(strings.ToLower(base), "http") || strings.HasPrefix(base, "//") {
+				panic(configError("Absolute base tags are not supported"))
+			}
+
+			if strings.HasSuffix(base, "/") {
+				base = base[:len(base)-1]
+			}
+
+			htmlFiles[i] = HTMLFile{
+				File: *file,
+				Deps: make([]FileInst, 0, len(deps)),
+				Base: base,
+			}
+
+			var dest string
+			if strings.HasPrefix(base, "/") && strings.HasPrefix(base, "/"+options.Dest) {
+				dest = base
+			} else {
+				dest = joinPath(options.Dest, base)
+			}
+
+			var root string
+			if strings.HasPrefix(base, "/") && strings.HasSuffix(options.Root, base) {
+				root = options.Root
+			} else {
+				root = joinPath(options.Root, base)
+			}
+
+			for _, dep := range deps {
+				path := refPath(dep.Path)
+
+				var local, remote string
+				if strings.HasPrefix(path, "/") {
+					local = joinPath(options.Root, path)
+					remote = joinPath(options.Dest, path)
+				} else {
+					if strings.HasPrefix(base, "/") {
+						local = joinPath(root, path)
+						remote = joinPath(dest, path)
+					} else {
+						local = joinPath(options.Root, rel, base, path)
+						remote = joinPath(options.Dest, rel, base, path)
+					}
+				}
+
+				for strings.HasPrefix(remote, "../") {
+					remote = remote[3:]
+				}
+
+				if dep.Optional {
+					if _, err := os.Stat(local); err != nil {
+						log.Printf("Not versioning %s referenced in %s, as it could not be found locally\n", dep.Path, file.LocalPath)
+						continue
+					}
+				}
+
+				ref := includeFile(options, inclFiles, local, remote, dep.Module)
+
+				use := FileInst{
+					File:     ref,
+					InstPath: dep.Path,
+				}
+
+				htmlFiles[i].Deps = append(htmlFiles[i].Deps, use)
+			}
+		}
+
+		inclFileList = make([]*FileRef, len(inclFiles))
+		i := 0
+		for _, ref := range inclFiles {
+			inclFileList[i] = ref
+			i++
+		}
+	}
+
+	if len(headerBlocks) != 0 {
+		options.Headers = options.Headers.merge(headersFileRules(headerBlocks, relativePaths(options, files, inclFileList)))
+	}
+
+	if len(inclFileList) != 0 {
+		if err := r.deployGraph(options, inclFileList); err != nil {
+			return nil, err
+		}
+	}
+
+	// The html can only be rendered once the files it points to have their hashed paths
+	for i := range htmlFiles {
+		htmlFiles[i].Rendered = renderHTML(options, htmlFiles[i])
+	}
+
+	id := deployId(options, files, inclFileList, htmlFiles, redirects)
+
+	fileId := ""
+	if options.VersionAll || options.Atomic {
+		fileId = id
+	}
+	if err := r.deployFiles(options, fileId, false, otherFiles); err != nil {
+		return nil, err
+	}
+
+	if len(htmlFileRefs) != 0 {
+		ch := make(chan *HTMLFile)
+		errs := r.newFileErrors()
+
+		wg := new(sync.WaitGroup)
+		for i := 0; i < UPLOAD_WORKERS; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for file := range ch {
+					if err := r.uploadHTML(options, id, file); err != nil {
+						log.Printf("Error uploading %s: %s\n", file.File.LocalPath, err)
+						errs.add(file.File.LocalPath, err)
+					}
+				}
+			}()
+		}
+
+		for i := range htmlFiles {
+			if r.cancelled() {
+				break
+			}
+			ch <- &htmlFiles[i]
+		}
+
+		close(ch)
+
+		wg.Wait()
+
+		if err := r.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Nothing has been made live yet, so we can stop without leaving the site in a mixed state
+		if err := errs.err("upload", len(htmlFiles)); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Atomic {
+		r.copyVersioned(options, id, inclFileList)
+
+		// Everything is served from under the deploy id, redirects included
+		for _, redirect := range redirectObjects {
+			redirect.Key = joinPath(id, redirect.Key)
+			r.putRedirect(redirect)
+		}
+
+		if len(routingRules) != 0 {
+			log.Printf("Skipping %d redirects which need routing rules, as they aren't supported by atomic deploys\n", len(routingRules))
+		}
+	}
+
+	r.writeManifest(options, buildManifest(options, id, inclFileList, otherFiles, htmlFiles))
+
+	if options.Lock {
+		lock := r.acquireLock(options, "deploying "+id, lockTTL(options, DEFAULT_LOCK_TTL))
+		defer r.releaseLock(options, lock)
+	} else {
+		r.checkLock(options)
+	}
+
+	if options.Atomic {
+		r.setOriginPath(options, id)
+	} else {
+		if err := r.activateDeploy(options, id, otherFiles, htmlFiles, hasRedirects, redirectObjects, routingRules); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DeployResult{
+		Result:        r.result(options, "deploy", start),
+		Id:            id,
+		Uploaded:      r.stats.Uploaded,
+		UploadedBytes: r.stats.UploadedBytes,
+		Skipped:       r.stats.Skipped,
+		SkippedBytes:  r.stats.SkippedBytes,
+		Activated:     r.stats.Activated,
+	}, nil
+}
+
+// activateDeploy copies the files stored under the deploy id to their live paths.  Every file is
+// attempted even if some fail, so as much of the site as possible is consistent.
+func (r *run) activateDeploy(options Options, id string, otherFiles []*FileRef, htmlFiles []HTMLFile, hasRedirects bool, redirectObjects []RedirectObject, routingRules []routingRule) error {
+	if (len(htmlFiles) != 0 || options.VersionAll) && !options.DryRun {
+		// Ensure that the new files exist in s3
+		// Time based on "Eventual Consistency: How soon is eventual?"
+		r.sleep(1500 * time.Millisecond)
+	}
+
+	if options.VersionAll {
+		// Other files are activated first, so the new html never points to files which are not live yet
+		if err := r.activateFiles(options, id, otherFiles); err != nil {
+			return err
+		}
+	}
+
+	if len(htmlFiles) != 0 {
+		ch := make(chan HTMLFile)
+		errs := r.newFileErrors()
+
+		wg := new(sync.WaitGroup)
+		for i := 0; i < UPLOAD_WORKERS; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for file := range ch {
+					if err := r.activateHTML(options, id, file); err != nil {
+						log.Printf("Error copying %s: %s\n", file.File.UploadedPath, err)
+						errs.add(file.File.UploadedPath, err)
+					}
+				}
+			}()
+		}
+
+		for _, file := range htmlFiles {
+			if r.cancelled() {
+				break
+			}
+			ch <- file
+		}
+
+		close(ch)
+
+		wg.Wait()
+
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		if err := errs.err("copy", len(htmlFiles)); err != nil {
+			return err
+		}
+	}
+
+	if hasRedirects {
+		r.deployRedirects(options, redirectObjects, routingRules)
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/zackbloom/goamz/aws"
+	"github.com/zackbloom/goamz/iam"
+	"github.com/zackbloom/goamz/s3"
+)
+
+// Exit codes, so CI can tell why a command failed
+const (
+	EXIT_ERROR     = 1 // Anything we don't have a more specific code for
+	EXIT_CONFIG    = 2 // The options or config file are invalid
+	EXIT_AUTH      = 3 // AWS rejected the credentials, or they don't have permission
+	EXIT_NOT_FOUND = 4 // The bucket, deploy or distribution doesn't exist
+	EXIT_PARTIAL   = 5 // Some files failed to upload or copy, the rest were
+	EXIT_LOCKED    = 6 // Someone else holds the lock
+	EXIT_CANCELLED = 7 // The user answered no, or the context was cancelled
+)
+
+// Error is a failure with a message meant for the user, and the exit code it should cause.
+type Error struct {
+	Code    int
+	Message string
+
+	// What caused it, if it wasn't us
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func newError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func configError(format string, args ...interface{}) *Error {
+	return newError(EXIT_CONFIG, format, args...)
+}
+
+func lockedError(format string, args ...interface{}) *Error {
+	return newError(EXIT_LOCKED, format, args...)
+}
+
+// wrapError adds a message to an error, keeping the exit code it would have caused
+func wrapError(err error, format string, args ...interface{}) *Error {
+	return &Error{Code: ExitCode(err), Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// FileError is the failure of a single file.  Workers collect them rather than stopping, so one file
+// failing doesn't take the others down with it.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+// PartialError is returned when some of the files being uploaded or copied failed.
+type PartialError struct {
+	Action string
+	Total  int
+	Failed []FileError
+}
+
+// How many of the failures are listed in the message
+const MAX_LISTED_ERRORS = 10
+
+func (e *PartialError) Error() string {
+	lines := []string{fmt.Sprintf("%d of %d files failed to %s", len(e.Failed), e.Total, e.Action)}
+
+	for i, failed := range e.Failed {
+		if i == MAX_LISTED_ERRORS {
+			lines = append(lines, fmt.Sprintf("  and %d more", len(e.Failed)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", failed.Path, failed.Err))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// code is EXIT_PARTIAL, unless every file failed for the same reason (bad credentials for example)
+func (e *PartialError) code() int {
+	code := 0
+	for _, failed := range e.Failed {
+		c := ExitCode(failed.Err)
+		if code != 0 && c != code {
+			return EXIT_PARTIAL
+		}
+		code = c
+	}
+
+	if code == 0 || code == EXIT_ERROR {
+		return EXIT_PARTIAL
+	}
+	return code
+}
+
+// fileErrors collects the failures of workers
+type fileErrors struct {
+	sync.Mutex
+	failed []FileError
+
+	emit func(Event)
+}
+
+func (r *run) newFileErrors() *fileErrors {
+	return &fileErrors{emit: r.emit}
+}
+
+func (f *fileErrors) add(path string, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.failed = append(f.failed, FileError{Path: path, Err: err})
+
+	f.emit(Event{
+		Event: "failed",
+		Path:  path,
+		Error: err.Error(),
+		Code:  ExitCode(err),
+	})
+}
+
+func (f *fileErrors) count() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.failed)
+}
+
+// err returns a PartialError if any file failed, or nil if none did
+func (f *fileErrors) err(action string, total int) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.failed) == 0 {
+		return nil
+	}
+	return &PartialError{Action: action, Total: total, Failed: f.failed}
+}
+
+func awsExitCode(status int, code string) int {
+	switch code {
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied", "InvalidClientTokenId",
+		"ExpiredToken", "MissingAuthenticationToken", "AuthFailure":
+		return EXIT_AUTH
+	case "NoSuchBucket", "NoSuchDistribution", "NoSuchKey", "NoSuchHostedZone":
+		return EXIT_NOT_FOUND
+	}
+
+	switch status {
+	case 401, 403:
+		return EXIT_AUTH
+	case 404:
+		return EXIT_NOT_FOUND
+	}
+	return EXIT_ERROR
+}
+
+// ExitCode is the code the command line tool exits with because of err
+func ExitCode(err error) int {
+	switch err {
+	case context.Canceled:
+		return EXIT_CANCELLED
+	case ErrNotFound:
+		return EXIT_NOT_FOUND
+	}
+
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *Error:
+		return e.Code
+	case *PartialError:
+		return e.code()
+	case *s3.Error:
+		return awsExitCode(e.StatusCode, e.Code)
+	case *aws.Error:
+		return awsExitCode(e.StatusCode, e.Code)
+	case *iam.Error:
+		return awsExitCode(e.StatusCode, e.Code)
+	}
+	return EXIT_ERROR
+}
+
+// Stout panics when something fails (see panicIf and must), recoverError turns the panic back into an
+// error at the edge of each command and worker.  Runtime errors are bugs, so they still crash with a trace.
+func recoverError(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	switch e := r.(type) {
+	case runtime.Error:
+		panic(e)
+	case error:
+		*err = e
+	case string:
+		*err = &Error{Code: EXIT_ERROR, Message: e}
+	default:
+		*err = fmt.Errorf("%v", e)
+	}
+}
@@ -0,0 +1,82 @@
+package deploy
+
+import (
+	"time"
+)
+
+// An Event is passed to Client.Progress as each command runs.  With --output json the command line
+// tool writes them to stdout, one per line, ending with the command's result.
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	Path            string `json:"path,omitempty"`
+	From            string `json:"from,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	Hash            string `json:"hash,omitempty"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Detail          string `json:"detail,omitempty"`
+	Error           string `json:"error,omitempty"`
+	Code            int    `json:"code,omitempty"`
+}
+
+// Result is embedded in the result of each command, which is also the last event --output json writes
+type Result struct {
+	Event    string  `json:"event"`
+	Command  string  `json:"command"`
+	DryRun   bool    `json:"dryRun,omitempty"`
+	Duration float64 `json:"duration"`
+
+	// The requests a dry run would have made
+	Plan []PlannedAction `json:"-"`
+}
+
+type DeployResult struct {
+	Result
+	Id            string `json:"id"`
+	Uploaded      int    `json:"uploaded"`
+	UploadedBytes int64  `json:"uploadedBytes"`
+	Skipped       int    `json:"skipped"`
+	SkippedBytes  int64  `json:"skippedBytes"`
+	Activated     int    `json:"activated"`
+}
+
+type RollbackResult struct {
+	Result
+	Id       string `json:"id"`
+	Restored int    `json:"restored"`
+	Removed  int    `json:"removed"`
+}
+
+type PruneResult struct {
+	Result
+	Deploys      int   `json:"deploys"`
+	Deleted      int   `json:"deleted"`
+	DeletedBytes int64 `json:"deletedBytes"`
+}
+
+type LockResult struct {
+	Result
+	Path string      `json:"path"`
+	Lock *DeployLock `json:"lock,omitempty"`
+}
+
+type CreateResult struct {
+	Result
+	Bucket          string `json:"bucket"`
+	Distribution    string `json:"distribution,omitempty"`
+	DomainName      string `json:"domainName,omitempty"`
+	AccessKeyId     string `json:"accessKeyId,omitempty"`
+	AccessKeySecret string `json:"accessKeySecret,omitempty"`
+}
+
+type ListResult struct {
+	Result
+	Deploys []DeployInfo `json:"deploys"`
+}
+
+type StatusResult struct {
+	Result
+	SiteStatus
+}
@@ -0,0 +1,151 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Headers are set on the files matching a rule in the `headers` section of the config.  Empty
+// values leave the header as Stout would otherwise set it.
+type Headers struct {
+	CacheControl       string            `yaml:"cacheControl" json:"cacheControl,omitempty"`
+	ContentType        string            `yaml:"contentType" json:"contentType,omitempty"`
+	ContentDisposition string            `yaml:"contentDisposition" json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `yaml:"contentLanguage" json:"contentLanguage,omitempty"`
+	Meta               map[string]string `yaml:"meta" json:"meta,omitempty"`
+}
+
+// HeaderRules map globs (or MIME types, see matchesRule) to the headers of the files they match.
+type HeaderRules map[string]Headers
+
+func (h Headers) empty() bool {
+	return h.CacheControl == "" && h.ContentType == "" && h.ContentDisposition == "" &&
+		h.ContentLanguage == "" && len(h.Meta) == 0
+}
+
+// rulesBySpecificity orders rules so the longest (and usually most specific) comes last, and wins
+type rulesBySpecificity []string
+
+func (r rulesBySpecificity) Len() int      { return len(r) }
+func (r rulesBySpecificity) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rulesBySpecificity) Less(i, j int) bool {
+	if len(r[i]) != len(r[j]) {
+		return len(r[i]) < len(r[j])
+	}
+	return r[i] < r[j]
+}
+
+func (rules HeaderRules) sorted() []string {
+	keys := make([]string, 0, len(rules))
+	for rule := range rules {
+		keys = append(keys, rule)
+	}
+	sort.Sort(rulesBySpecificity(keys))
+	return keys
+}
+
+// match combines the headers of every rule which matches file (a path relative to the dest, with the
+// detected contentType).  When more than one rule sets a header, the longest rule wins.
+func (rules HeaderRules) match(file, contentType string) Headers {
+	var out Headers
+
+	for _, rule := range rules.sorted() {
+		if !matchesRule(rule, file, contentType) {
+			continue
+		}
+
+		out = out.merge(rules[rule])
+	}
+
+	return out
+}
+
+// merge returns the rules of both, with those in other replacing any of the same name
+func (rules HeaderRules) merge(other HeaderRules) HeaderRules {
+	out := make(HeaderRules)
+	for rule, h := range rules {
+		out[rule] = h
+	}
+	for rule, h := range other {
+		out[rule] = h
+	}
+	return out
+}
+
+// merge returns h with the headers set in other replacing its own
+func (h Headers) merge(other Headers) Headers {
+	if other.CacheControl != "" {
+		h.CacheControl = other.CacheControl
+	}
+	if other.ContentType != "" {
+		h.ContentType = other.ContentType
+	}
+	if other.ContentDisposition != "" {
+		h.ContentDisposition = other.ContentDisposition
+	}
+	if other.ContentLanguage != "" {
+		h.ContentLanguage = other.ContentLanguage
+	}
+
+	if len(other.Meta) != 0 {
+		meta := make(map[string]string)
+		for k, v := range h.Meta {
+			meta[k] = v
+		}
+		for k, v := range other.Meta {
+			meta[strings.ToLower(k)] = v
+		}
+		h.Meta = meta
+	}
+
+	return h
+}
+
+// write adds the rules to the deploy id hash
+func (rules HeaderRules) write(w io.Writer) {
+	for _, rule := range rules.sorted() {
+		h := rules[rule]
+
+		meta := make([]string, 0, len(h.Meta))
+		for k, v := range h.Meta {
+			meta = append(meta, fmt.Sprintf("%d:%s=%d:%s", len(k), k, len(v), v))
+		}
+		sort.Strings(meta)
+
+		fmt.Fprintf(w, "header %d:%s %q %q %q %q %s\n", len(rule), rule, h.CacheControl, h.ContentType,
+			h.ContentDisposition, h.ContentLanguage, strings.Join(meta, " "))
+	}
+}
+
+func checkHeaders(o Options) {
+	for rule, h := range o.Headers {
+		if _, err := path.Match(rule, ""); err != nil {
+			panic(configError("Invalid header rule %s: %s", rule, err))
+		}
+
+		for k := range h.Meta {
+			if key := strings.ToLower(k); key == DEPLOY_META || key == MD5_META {
+				panic(configError("The %s metadata is set by Stout, it can't be set in a header rule", k))
+			}
+		}
+	}
+}
+
+// apply sets the headers on obj, other than the Content-Type which uploadFile has already worked out.
+func (h Headers) apply(obj *Object) {
+	if h.CacheControl != "" {
+		obj.CacheControl = h.CacheControl
+	}
+	obj.ContentDisposition = h.ContentDisposition
+	obj.ContentLanguage = h.ContentLanguage
+
+	for k, v := range h.Meta {
+		if obj.Meta == nil {
+			obj.Meta = make(map[string]string)
+		}
+		obj.Meta[strings.ToLower(k)] = v
+	}
+}
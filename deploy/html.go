@@ -0,0 +1,288 @@
+package deploy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The element attributes (other than script and stylesheet references) which are versioned by default.
+const DEFAULT_HTML_REFS = "img:src,img:srcset,source:src,source:srcset,video:src,video:poster,audio:src," +
+	"link[rel=icon]:href,link[rel=apple-touch-icon]:href,link[rel=preload]:href,link[rel=preload]:imagesrcset," +
+	"link[rel=manifest]:href,meta[property=og:image]:content"
+
+// An HTMLRef is an element attribute which references a file.  They are written as tag:attr, or
+// tag[key=value]:attr to only match elements which have an attribute with that value (for attributes
+// like rel, which are a list of values, any one of them can match).
+type HTMLRef struct {
+	Tag   string
+	Attr  string
+	Key   string
+	Value string
+}
+
+// Scripts and stylesheets are always versioned, whatever the configured refs.
+var builtinHTMLRefs = []HTMLRef{
+	{Tag: "script", Attr: "src"},
+	{Tag: "link", Attr: "href", Key: "rel", Value: "stylesheet"},
+	{Tag: "link", Attr: "href", Key: "rel", Value: "modulepreload"},
+}
+
+func parseHTMLRefs(spec string) []HTMLRef {
+	refs := make([]HTMLRef, 0)
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var ref HTMLRef
+
+		sep := strings.LastIndex(part, ":")
+		if sep == -1 || strings.LastIndex(part, "]") > sep {
+			panic(configError("HTML refs must be written as tag:attr or tag[key=value]:attr, not %s", part))
+		}
+
+		ref.Attr = strings.ToLower(part[sep+1:])
+		ref.Tag = strings.ToLower(part[:sep])
+
+		if open := strings.Index(ref.Tag, "["); open != -1 {
+			filter := strings.TrimSuffix(part[open+1:sep], "]")
+			ref.Tag = ref.Tag[:open]
+
+			eq := strings.Index(filter, "=")
+			if eq == -1 {
+				panic(configError("HTML ref filters must be written as [key=value], not %s", part))
+			}
+
+			ref.Key = strings.ToLower(filter[:eq])
+			ref.Value = strings.ToLower(strings.Trim(filter[eq+1:], `"'`))
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+func getHTMLRefs(options Options) []HTMLRef {
+	spec := options.HTMLRefs
+	if spec == "" {
+		spec = DEFAULT_HTML_REFS
+	}
+
+	return append(parseHTMLRefs(spec), builtinHTMLRefs...)
+}
+
+func (r HTMLRef) matches(n *html.Node) bool {
+	if n.Data != r.Tag {
+		return false
+	}
+	if r.Key == "" {
+		return true
+	}
+
+	for _, a := range n.Attr {
+		if a.Key != r.Key {
+			continue
+		}
+
+		for _, val := range strings.Fields(strings.ToLower(a.Val)) {
+			if val == r.Value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isBuiltinRef(r HTMLRef) bool {
+	for _, b := range builtinHTMLRefs {
+		if b == r {
+			return true
+		}
+	}
+	return false
+}
+
+func isModuleNode(n *html.Node) bool {
+	for _, a := range n.Attr {
+		switch {
+		case n.Data == "script" && a.Key == "type":
+			return a.Val == "module"
+		case n.Data == "link" && a.Key == "rel":
+			return a.Val == "modulepreload"
+		}
+	}
+	return false
+}
+
+func isSrcset(attr string) bool {
+	return attr == "srcset" || attr == "imagesrcset"
+}
+
+// srcsetURLs returns the start and end offsets of each candidate url in a srcset attribute.
+func srcsetURLs(val string) [][2]int {
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+	}
+
+	out := make([][2]int, 0)
+
+	i := 0
+	for i < len(val) {
+		for i < len(val) && (isSpace(val[i]) || val[i] == ',') {
+			i++
+		}
+
+		start := i
+		for i < len(val) && !isSpace(val[i]) {
+			i++
+		}
+
+		// A url which ends in a comma has no descriptors
+		end := i
+		for end > start && val[end-1] == ',' {
+			end--
+		}
+
+		if end > start {
+			out = append(out, [2]int{start, end})
+		}
+		if end < i {
+			continue
+		}
+
+		for i < len(val) && val[i] != ',' {
+			i++
+		}
+	}
+
+	return out
+}
+
+// mapAttrRefs calls fn with each reference in the value of attr, replacing it with the value returned.
+func mapAttrRefs(attr, val string, fn func(ref string) string) string {
+	if !isSrcset(attr) {
+		return fn(val)
+	}
+
+	spans := srcsetURLs(val)
+	for i := len(spans) - 1; i >= 0; i-- {
+		start, end := spans[i][0], spans[i][1]
+		val = val[:start] + fn(val[start:end]) + val[end:]
+	}
+
+	return val
+}
+
+// walkHTMLRefs calls fn with every attribute in doc which matches one of refs.
+func walkHTMLRefs(doc *html.Node, refs []HTMLRef, fn func(n *html.Node, ref HTMLRef, attr *html.Attribute)) {
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+
+		if n.Type != html.ElementNode {
+			return
+		}
+
+		for _, ref := range refs {
+			if !ref.matches(n) {
+				continue
+			}
+
+			for i := range n.Attr {
+				if n.Attr[i].Key == ref.Attr {
+					fn(n, ref, &n.Attr[i])
+				}
+			}
+		}
+	}
+	f(doc)
+}
+
+func renderHTML(options Options, file HTMLFile) string {
+	handle := must(os.Open(file.File.LocalPath)).(*os.File)
+	defer handle.Close()
+
+	doc := must(html.Parse(handle)).(*html.Node)
+
+	walkHTMLRefs(doc, getHTMLRefs(options), func(n *html.Node, ref HTMLRef, attr *html.Attribute) {
+		attr.Val = mapAttrRefs(attr.Key, attr.Val, func(val string) string {
+			for _, dep := range file.Deps {
+				if dep.InstPath == val {
+					return formatHref(dep.File.UploadedPath) + refSuffix(val)
+				}
+			}
+			return val
+		})
+	})
+
+	buf := bytes.NewBuffer([]byte{})
+	panicIf(html.Render(buf, doc))
+
+	return buf.String()
+}
+
+type HTMLDep struct {
+	Path string
+
+	// Loaded as an ES module
+	Module bool
+
+	// References to files which can't be found locally are left alone, rather than failing the deploy
+	Optional bool
+}
+
+// parseHTML returns the local files referenced by the html file at path.
+func parseHTML(options Options, path string) (deps []HTMLDep, base string) {
+	deps = make([]HTMLDep, 0)
+
+	handle := must(os.Open(path)).(*os.File)
+	defer handle.Close()
+
+	doc := must(html.Parse(handle)).(*html.Node)
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+
+		if n.Type == html.ElementNode && n.Data == "base" {
+			for _, a := range n.Attr {
+				if a.Key == "href" {
+					base = a.Val
+				}
+			}
+		}
+	}
+	f(doc)
+
+	walkHTMLRefs(doc, getHTMLRefs(options), func(n *html.Node, ref HTMLRef, attr *html.Attribute) {
+		mapAttrRefs(attr.Key, attr.Val, func(val string) string {
+			// Pages are never versioned, they have to stay at the paths people link to (a prefetched
+			// page for example)
+			if strings.HasSuffix(refPath(val), ".html") {
+				return val
+			}
+
+			if val != "" && isLocal(val) {
+				deps = append(deps, HTMLDep{
+					Path:     val,
+					Module:   isModuleNode(n),
+					Optional: !isBuiltinRef(ref),
+				})
+			}
+			return val
+		})
+	})
+
+	return
+}
@@ -0,0 +1,58 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var jsImportRes = []*regexp.Regexp{
+	// import x from "./x.js", import {a, b as c} from "./x.js", import "./x.js"
+	regexp.MustCompile(`\bimport\s*(?:[\w$*{},\s]+?\s*from\s*)?"([^"\n]+)"`),
+	regexp.MustCompile(`\bimport\s*(?:[\w$*{},\s]+?\s*from\s*)?'([^'\n]+)'`),
+
+	// export * from "./x.js", export {a} from "./x.js"
+	regexp.MustCompile(`\bexport\s*(?:\*(?:\s*as\s+[\w$]+)?|\{[^}]*\})\s*from\s*"([^"\n]+)"`),
+	regexp.MustCompile(`\bexport\s*(?:\*(?:\s*as\s+[\w$]+)?|\{[^}]*\})\s*from\s*'([^'\n]+)'`),
+
+	// import("./x.js")
+	regexp.MustCompile("\\bimport\\s*\\(\\s*(?:\"([^\"\\n]+)\"|'([^'\\n]+)'|`([^`$\\n]+)`)\\s*\\)"),
+}
+
+// isModuleRef is true for the relative and absolute specifiers we can resolve to local files.  Bare
+// specifiers ("lodash") are resolved by an import map or bundler, not by us.
+func isModuleRef(ref string) bool {
+	if !(strings.HasPrefix(ref, "./") || strings.HasPrefix(ref, "../") || strings.HasPrefix(ref, "/")) {
+		return false
+	}
+
+	return isLocal(ref)
+}
+
+func parseJS(path string) (files []string) {
+	files = make([]string, 0)
+
+	data := must(ioutil.ReadFile(path)).([]byte)
+
+	replaceRefs(string(data), jsImportRes, func(ref string) string {
+		if isModuleRef(ref) {
+			files = append(files, ref)
+		}
+		return ref
+	})
+
+	return
+}
+
+func renderJS(file *FileRef) string {
+	data := must(ioutil.ReadFile(file.LocalPath)).([]byte)
+
+	return replaceRefs(string(data), jsImportRes, func(ref string) string {
+		for _, dep := range file.Deps {
+			if dep.InstPath == ref {
+				return formatHref(dep.File.UploadedPath) + refSuffix(ref)
+			}
+		}
+		return ref
+	})
+}
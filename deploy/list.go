@@ -0,0 +1,84 @@
+package deploy
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deploys made before manifests were written can only be recognized by the shape of their id
+var legacyIdRe = regexp.MustCompile("^[0-9a-f]{12}$")
+
+type DeployInfo struct {
+	Id       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Ref      string    `json:"ref,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Live     bool      `json:"live"`
+	Manifest *Manifest `json:"-"`
+}
+
+// listDeploys finds every deploy under the dest, newest first.  Deploys without a manifest are
+// listed last, as we don't know when they were made.
+func (r *run) listDeploys(options Options) []DeployInfo {
+	prefix := destPrefix(options)
+	_, prefixes := r.listAll(prefix, "/")
+
+	deploys := make([]DeployInfo, 0)
+	for _, dir := range prefixes {
+		id := strings.TrimSuffix(dir[len(prefix):], "/")
+
+		manifest := r.readManifest(options, id)
+		if manifest == nil {
+			if legacyIdRe.MatchString(id) {
+				deploys = append(deploys, DeployInfo{Id: id})
+			}
+			continue
+		}
+
+		deploys = append(deploys, DeployInfo{
+			Id:       id,
+			Time:     manifest.Time,
+			Ref:      manifest.Ref,
+			User:     manifest.User,
+			Manifest: manifest,
+		})
+	}
+
+	sort.Stable(deploysByTime(deploys))
+
+	return deploys
+}
+
+type deploysByTime []DeployInfo
+
+func (d deploysByTime) Len() int      { return len(d) }
+func (d deploysByTime) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d deploysByTime) Less(i, j int) bool {
+	if d[i].Manifest == nil || d[j].Manifest == nil {
+		return d[j].Manifest == nil && d[i].Manifest != nil
+	}
+	return d[i].Time.After(d[j].Time)
+}
+
+// List finds the deploys which have been made, newest first, and whether each is live.
+func (c *Client) List(ctx context.Context, options Options) (result *ListResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	deploys := r.listDeploys(options)
+
+	live := make(map[string]bool)
+	for _, page := range r.pageStatus(options, deploys) {
+		live[page.Id] = true
+	}
+	for i := range deploys {
+		deploys[i].Live = live[deploys[i].Id]
+	}
+
+	return &ListResult{r.result(options, "list", start), deploys}, nil
+}
@@ -0,0 +1,302 @@
+package deploy
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The directory under LocalStorage.Root the headers and metadata of each file are kept in
+const LOCAL_META_DIR = ".stout-meta"
+
+// Files are written to a temporary file with this prefix first, so they're replaced all at once
+const LOCAL_TEMP_PREFIX = ".stout-tmp-"
+
+// Redirect objects are written as a page which sends the browser on to their location
+const LOCAL_REDIRECT_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="0; url=%[1]s">
+<link rel="canonical" href="%[1]s">
+</head>
+<body><a href="%[1]s">%[1]s</a></body>
+</html>
+`
+
+// LocalStorage stores deploys in a directory served by nginx or another web server.  A filesystem has
+// nowhere to keep headers, so they're written to a JSON file for each key under Root/.stout-meta.
+// Gzipped objects are written decompressed, with the gzipped copy alongside at <key>.gz for nginx's
+// gzip_static, and redirect objects are written as an html page which refreshes to their location.
+type LocalStorage struct {
+	Root string
+}
+
+func (s *LocalStorage) Name() string {
+	return s.Root
+}
+
+// file is where key is written, keys can't point outside of Root or into the metadata
+func (s *LocalStorage) file(key string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if rel == "" || rel == LOCAL_META_DIR || strings.HasPrefix(rel, LOCAL_META_DIR+"/") {
+		panic(fmt.Errorf("%s can't be written to a local directory", key))
+	}
+
+	return filepath.Join(s.Root, filepath.FromSlash(rel))
+}
+
+func (s *LocalStorage) metaFile(key string) string {
+	rel := must(filepath.Rel(s.Root, s.file(key))).(string)
+	return filepath.Join(s.Root, LOCAL_META_DIR, rel+".json")
+}
+
+// readMeta returns the headers key was written with, or nil if it wasn't written by us
+func (s *LocalStorage) readMeta(key string) *Object {
+	data, err := ioutil.ReadFile(s.metaFile(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	panicIf(err)
+
+	var obj Object
+	panicIf(json.Unmarshal(data, &obj))
+
+	obj.Key = key
+	return &obj
+}
+
+// stored is the file holding the contents of key as they were uploaded
+func (s *LocalStorage) stored(key string, meta *Object) string {
+	if meta != nil && meta.ContentEncoding == "gzip" && meta.RedirectLocation == "" {
+		return s.file(key) + ".gz"
+	}
+	return s.file(key)
+}
+
+// writeLocalFile replaces name with the contents of src, using a temporary file so the web server never
+// serves part of it.  If md5Hex is set and doesn't match the contents, name is left alone.
+func writeLocalFile(name string, mode os.FileMode, src io.Reader, md5Hex string) (size int64, etag string) {
+	dir := filepath.Dir(name)
+	panicIf(os.MkdirAll(dir, 0755))
+
+	temp := must(ioutil.TempFile(dir, LOCAL_TEMP_PREFIX)).(*os.File)
+	defer os.Remove(temp.Name())
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), src)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	panicIf(err)
+
+	etag = hex.EncodeToString(hash.Sum(nil))
+	if md5Hex != "" && md5Hex != etag {
+		panic(fmt.Errorf("The contents written to %s don't match their MD5", name))
+	}
+
+	panicIf(os.Chmod(temp.Name(), mode))
+	panicIf(os.Rename(temp.Name(), name))
+	return
+}
+
+func removeLocalFile(name string) {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
+
+// removeEmptyDirs removes dir and its parents until one isn't empty, stopping at root
+func removeEmptyDirs(root, dir string) {
+	root, dir = filepath.Clean(root), filepath.Clean(dir)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (s *LocalStorage) Put(obj Object, body io.Reader) (err error) {
+	defer recoverError(&err)
+
+	name := s.file(obj.Key)
+	previous := s.readMeta(obj.Key)
+
+	mode := os.FileMode(0644)
+	if obj.Private {
+		mode = 0600
+	}
+
+	switch {
+	case obj.RedirectLocation != "":
+		location := html.EscapeString(obj.RedirectLocation)
+		obj.Size, obj.ETag = writeLocalFile(name, mode, strings.NewReader(fmt.Sprintf(LOCAL_REDIRECT_PAGE, location)), "")
+
+	case obj.ContentEncoding == "gzip":
+		obj.Size, obj.ETag = writeLocalFile(name+".gz", mode, body, obj.MD5)
+
+		compressed := must(os.Open(name + ".gz")).(*os.File)
+		defer compressed.Close()
+
+		reader := must(gzip.NewReader(compressed)).(*gzip.Reader)
+		writeLocalFile(name, mode, reader, "")
+
+	default:
+		obj.Size, obj.ETag = writeLocalFile(name, mode, body, obj.MD5)
+	}
+
+	// Otherwise the server would keep sending the old contents to browsers which accept gzip
+	if old := s.stored(obj.Key, previous); old != name && old != s.stored(obj.Key, &obj) {
+		removeLocalFile(old)
+	}
+
+	obj.LastModified = time.Now().UTC()
+	data := must(json.MarshalIndent(obj, "", "  ")).([]byte)
+	writeLocalFile(s.metaFile(obj.Key), 0644, strings.NewReader(string(data)), "")
+
+	return nil
+}
+
+// Copy writes the contents of from to obj.Key as they were uploaded, so the copy has the same ETag.
+func (s *LocalStorage) Copy(from string, obj Object) (err error) {
+	defer recoverError(&err)
+
+	source, err := os.Open(s.stored(from, s.readMeta(from)))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	panicIf(err)
+	defer source.Close()
+
+	obj.Size = must(source.Stat()).(os.FileInfo).Size()
+	obj.MD5 = ""
+	return s.Put(obj, source)
+}
+
+func (s *LocalStorage) Head(key string) (obj *Object, err error) {
+	defer recoverError(&err)
+
+	obj = s.readMeta(key)
+
+	info, err := os.Stat(s.stored(key, obj))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	panicIf(err)
+
+	if obj != nil {
+		return obj, nil
+	}
+
+	// A file someone put there themselves
+	data := must(ioutil.ReadFile(s.file(key))).([]byte)
+	return &Object{
+		Key:          key,
+		Size:         info.Size(),
+		ETag:         fmt.Sprintf("%x", md5.Sum(data)),
+		LastModified: info.ModTime().UTC(),
+		Meta:         make(map[string]string),
+	}, nil
+}
+
+func (s *LocalStorage) Get(key string) (data []byte, err error) {
+	defer recoverError(&err)
+
+	data, err = ioutil.ReadFile(s.stored(key, s.readMeta(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// List walks the directory the prefix is in, skipping the metadata, the temporary files of writes in
+// progress, and the gzipped copies Put writes alongside files.
+func (s *LocalStorage) List(prefix, delim string) (objects []Object, prefixes []string, err error) {
+	defer recoverError(&err)
+
+	dir := filepath.Join(s.Root, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
+
+	keys := make([]string, 0)
+	err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		key := filepath.ToSlash(must(filepath.Rel(s.Root, name)).(string))
+
+		if info.IsDir() {
+			if key == LOCAL_META_DIR {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	panicIf(err)
+
+	// The order S3 lists keys in, which isn't the order the directories are walked in
+	sort.Strings(keys)
+
+	objects = make([]Object, 0, len(keys))
+	prefixes = make([]string, 0)
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".gz") {
+			if meta := s.readMeta(strings.TrimSuffix(key, ".gz")); meta != nil && s.stored(meta.Key, meta) == s.file(key) {
+				continue
+			}
+		}
+
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i != -1 {
+				common := key[:len(prefix)+i+len(delim)]
+				if len(prefixes) == 0 || prefixes[len(prefixes)-1] != common {
+					prefixes = append(prefixes, common)
+				}
+				continue
+			}
+		}
+
+		obj, err := s.Head(key)
+		panicIf(err)
+
+		objects = append(objects, *obj)
+	}
+
+	return objects, prefixes, nil
+}
+
+func (s *LocalStorage) Delete(keys []string) (err error) {
+	defer recoverError(&err)
+
+	for _, key := range keys {
+		meta := s.readMeta(key)
+
+		removeLocalFile(s.file(key))
+		removeLocalFile(s.stored(key, meta))
+		removeLocalFile(s.metaFile(key))
+
+		removeEmptyDirs(s.Root, filepath.Dir(s.file(key)))
+		removeEmptyDirs(filepath.Join(s.Root, LOCAL_META_DIR), filepath.Dir(s.metaFile(key)))
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package deploy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, root, name, contents string) {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, root, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// storedKeys lists every key in the storage, as List returns them
+func storedKeys(t *testing.T, storage Storage) []string {
+	objects, _, err := storage.List("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func TestLocalDeployRedeployRollback(t *testing.T) {
+	src, err := ioutil.TempDir("", "stout-src-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "stout-dest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, src, "index.html", `<html><head><script src="/app.js"></script></head><body>first</body></html>`)
+	writeTestFile(t, src, "about/index.html", `<html><body>about</body></html>`)
+	writeTestFile(t, src, "app.js", `console.log("app")`)
+
+	ctx := context.Background()
+	client := &Client{}
+	storage := &LocalStorage{Root: dest}
+	options := Options{
+		Local:     dest,
+		Root:      src,
+		Dest:      "./",
+		Files:     "*.html,about/*.html",
+		GzipLevel: 6,
+	}
+
+	first, err := client.Deploy(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Skipped != 0 {
+		t.Errorf("The first deploy skipped %d files", first.Skipped)
+	}
+
+	// The script is versioned, the html is stored under the deploy id and copied to its live path
+	versioned := ""
+	for _, key := range storedKeys(t, storage) {
+		if strings.HasSuffix(key, "_app.js") {
+			versioned = key
+		}
+	}
+	if versioned == "" {
+		t.Fatal("The script wasn't uploaded to a hashed path")
+	}
+
+	expected := []string{
+		versioned,
+		first.Id + "/" + MANIFEST_NAME,
+		first.Id + "/about/index.html",
+		first.Id + "/index.html",
+		"about/index.html",
+		"index.html",
+	}
+	sort.Strings(expected)
+
+	if keys := storedKeys(t, storage); strings.Join(keys, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the keys %v, got %v", expected, keys)
+	}
+
+	live := readTestFile(t, dest, "index.html")
+	if !strings.Contains(live, `src="/`+versioned+`"`) || !strings.Contains(live, "first") {
+		t.Errorf("The live page doesn't point at the versioned script: %s", live)
+	}
+
+	manifest := client.start(ctx, options).readManifest(options, first.Id)
+	if manifest == nil {
+		t.Fatal("The deploy didn't write a manifest")
+	}
+	if manifest.Id != first.Id {
+		t.Errorf("The manifest is of %s, not %s", manifest.Id, first.Id)
+	}
+
+	kinds := make(map[string]string)
+	for _, file := range manifest.Files {
+		kinds[file.RemotePath] = file.Kind
+	}
+	if kinds["index.html"] != MANIFEST_HTML || kinds["about/index.html"] != MANIFEST_HTML || kinds["app.js"] != MANIFEST_VERSIONED {
+		t.Errorf("The manifest has the wrong files: %v", kinds)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, first.Id, MANIFEST_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0044 != 0 {
+		t.Errorf("The manifest is readable by everyone (%s)", info.Mode())
+	}
+
+	// Deploying the same files again produces the same id, and only the manifest (which records when
+	// the deploy was made) is uploaded again
+	again, err := client.Deploy(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Id != first.Id {
+		t.Errorf("Redeploying the same files changed the id from %s to %s", first.Id, again.Id)
+	}
+	if again.Uploaded != 1 || again.Skipped != first.Uploaded-1 {
+		t.Errorf("Expected the redeploy to upload 1 file and skip %d, it uploaded %d and skipped %d", first.Uploaded-1, again.Uploaded, again.Skipped)
+	}
+
+	writeTestFile(t, src, "index.html", `<html><head><script src="/app.js"></script></head><body>second</body></html>`)
+
+	second, err := client.Deploy(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id == first.Id {
+		t.Fatal("Changing a page didn't change the deploy id")
+	}
+	if live := readTestFile(t, dest, "index.html"); !strings.Contains(live, "second") {
+		t.Errorf("The second deploy isn't live: %s", live)
+	}
+
+	rollback, err := client.Rollback(ctx, options, first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollback.Id != first.Id {
+		t.Errorf("Rolled back to %s, not %s", rollback.Id, first.Id)
+	}
+
+	if live, stored := readTestFile(t, dest, "index.html"), readTestFile(t, dest, first.Id+"/index.html"); live != stored {
+		t.Errorf("The rollback didn't restore the first deploy's page, it is %s", live)
+	}
+
+	status, err := client.Status(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Mixed || len(status.Deploys) != 1 || status.Deploys[0] != first.Id {
+		t.Errorf("Expected every page to be served from %s after the rollback, got %v", first.Id, status.Deploys)
+	}
+}
+
+func TestLocalRollbackRedirectNewPages(t *testing.T) {
+	src, err := ioutil.TempDir("", "stout-src-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "stout-dest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, src, "index.html", `<html><body>first</body></html>`)
+
+	ctx := context.Background()
+	client := &Client{}
+	options := Options{
+		Local:     dest,
+		Root:      src,
+		Dest:      "./",
+		Files:     "*.html",
+		GzipLevel: 6,
+	}
+
+	first, err := client.Deploy(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, src, "new.html", `<html><body>new</body></html>`)
+
+	if _, err := client.Deploy(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := options
+	rollback.RedirectNewPages = "/"
+	rollback.Yes = true
+	if _, err := client.Rollback(ctx, rollback, first.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page the rollback redirected isn't part of any deploy, but it doesn't make the site mixed
+	status, err := client.Status(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Mixed || len(status.Deploys) != 1 || status.Deploys[0] != first.Id {
+		t.Errorf("Expected every page to be served from %s after the rollback, got %v", first.Id, status.Deploys)
+	}
+	if len(status.Redirects) != 1 || status.Redirects[0] != "new.html" || len(status.Unknown) != 0 {
+		t.Errorf("Expected new.html to be listed as a redirect, got %v (unknown %v)", status.Redirects, status.Unknown)
+	}
+}
+
+func TestLocalRollbackKeepsNestedDest(t *testing.T) {
+	src, err := ioutil.TempDir("", "stout-src-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	blogSrc, err := ioutil.TempDir("", "stout-src-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(blogSrc)
+
+	dest, err := ioutil.TempDir("", "stout-dest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTestFile(t, src, "index.html", `<html><body>site</body></html>`)
+	writeTestFile(t, blogSrc, "index.html", `<html><body>blog</body></html>`)
+
+	ctx := context.Background()
+	client := &Client{}
+	options := Options{
+		Local:     dest,
+		Root:      src,
+		Dest:      "./",
+		Files:     "*.html",
+		GzipLevel: 6,
+	}
+
+	blog := options
+	blog.Root = blogSrc
+	blog.Dest = "blog/"
+
+	first, err := client.Deploy(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Deploy(ctx, blog); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, src, "new.html", `<html><body>new</body></html>`)
+	if _, err := client.Deploy(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := options
+	rollback.RemoveNewPages = true
+	rollback.Yes = true
+	result, err := client.Rollback(ctx, rollback, first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the page our later deploy added is removed, the blog is another dest's
+	if result.Removed != 1 {
+		t.Errorf("Expected the rollback to remove 1 page, it removed %d", result.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "new.html")); !os.IsNotExist(err) {
+		t.Error("The page added after the deploy wasn't removed")
+	}
+	if live := readTestFile(t, dest, "blog/index.html"); !strings.Contains(live, "blog") {
+		t.Errorf("The rollback changed the blog's page: %s", live)
+	}
+}
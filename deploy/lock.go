@@ -0,0 +1,235 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// The lock is an object at the root of the dest which deploys and rollbacks hold while they make their
+// changes live, so two of them can't interleave.  It's advisory, S3 can't create an object only if it
+// doesn't already exist, so we write ours and read it back to see if someone else's replaced it.
+const LOCK_NAME = ".stout-lock.json"
+
+// How long the lock taken by a deploy or rollback lasts, in case it dies without releasing it
+const DEFAULT_LOCK_TTL = 15 * time.Minute
+
+// How long we wait after writing the lock before checking that another process didn't write theirs
+// at the same time
+const LOCK_SETTLE = 2 * time.Second
+
+// How long we keep trying to remove the lock, which is done even once the run has been cancelled
+const LOCK_RELEASE_TIMEOUT = 30 * time.Second
+
+type DeployLock struct {
+	Token  string    `json:"token"`
+	Owner  string    `json:"owner"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// Locks made with the lock command don't expire unless a --lock-ttl is given
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (l DeployLock) expired() bool {
+	return l.Expires != nil && time.Now().After(*l.Expires)
+}
+
+func (l DeployLock) String() string {
+	out := fmt.Sprintf("locked by %s since %s", l.Owner, l.Time.Local().Format("2006-01-02 15:04:05 MST"))
+	if l.Reason != "" {
+		out += fmt.Sprintf(" (%s)", l.Reason)
+	}
+	if l.Expires != nil {
+		out += fmt.Sprintf(", until %s", l.Expires.Local().Format("2006-01-02 15:04:05 MST"))
+	}
+	return out
+}
+
+func lockPath(options Options) string {
+	return joinPath(options.Dest, LOCK_NAME)
+}
+
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return getUser()
+	}
+	return getUser() + "@" + host
+}
+
+func lockToken() string {
+	token := make([]byte, 16)
+	must(rand.Read(token))
+	return hex.EncodeToString(token)
+}
+
+// lockTTL is how long a lock lasts, def is used if --lock-ttl isn't set (zero means forever)
+func lockTTL(options Options, def time.Duration) time.Duration {
+	if options.LockTTL == "" {
+		return def
+	}
+	return parseAge(options.LockTTL)
+}
+
+// readLock returns the current lock of the dest, or nil if it isn't locked
+func (r *run) readLock(options Options) *DeployLock {
+	data, err := r.storage.Get(lockPath(options))
+	if err == ErrNotFound {
+		return nil
+	}
+	panicIf(err)
+
+	var lock DeployLock
+	panicIf(json.Unmarshal(data, &lock))
+
+	return &lock
+}
+
+// checkLock fails if someone else holds the lock, unless --force-unlock is used.  Expired locks are
+// ignored.
+func (r *run) checkLock(options Options) *DeployLock {
+	existing := r.readLock(options)
+	if existing == nil {
+		return nil
+	}
+
+	if existing.expired() {
+		log.Printf("Ignoring the expired lock of %s\n", existing.Owner)
+		return existing
+	}
+
+	if !options.ForceUnlock {
+		panic(lockedError("%s is %s, use --force-unlock if you are sure it should be removed", r.storage.Name()+"/"+lockPath(options), *existing))
+	}
+
+	log.Printf("Taking the lock of %s, as --force-unlock was used\n", existing.Owner)
+	return existing
+}
+
+// acquireLock takes the lock of the dest for the current process, failing if someone else holds it.
+func (r *run) acquireLock(options Options, reason string, ttl time.Duration) *DeployLock {
+	r.checkLock(options)
+
+	now := time.Now().UTC()
+	lock := &DeployLock{
+		Token:  lockToken(),
+		Owner:  lockOwner(),
+		Reason: reason,
+		Time:   now,
+	}
+	if ttl != 0 {
+		expires := now.Add(ttl)
+		lock.Expires = &expires
+	}
+
+	path := lockPath(options)
+
+	if r.planned(PlannedAction{
+		Action: "s3:PutObject",
+		Path:   path,
+		Detail: "lock",
+	}) {
+		return lock
+	}
+
+	data := must(json.MarshalIndent(lock, "", "  ")).([]byte)
+
+	panicIf(r.retry(func() error {
+		return r.storage.Put(Object{
+			Key:          path,
+			Size:         int64(len(data)),
+			ContentType:  "application/json",
+			CacheControl: "no-cache",
+			Private:      true,
+		}, strings.NewReader(string(data)))
+	}, "writing lock"))
+
+	// Whoever wrote their lock last wins
+	r.sleep(LOCK_SETTLE)
+
+	current := r.readLock(options)
+	if current == nil || current.Token != lock.Token {
+		owner := "someone else"
+		if current != nil {
+			owner = current.Owner
+		}
+		panic(lockedError("%s was locked by %s at the same time, try again once they are done", r.storage.Name()+"/"+path, owner))
+	}
+
+	r.emit(Event{Event: "locked", Path: path, Detail: lock.String()})
+	return lock
+}
+
+// releaseLock removes our lock, leaving it alone if someone has since taken it from us.  It's removed even
+// if the run was cancelled, as otherwise every deploy would fail until it expired.
+func (r *run) releaseLock(options Options, lock *DeployLock) {
+	if lock == nil {
+		return
+	}
+
+	path := lockPath(options)
+
+	if r.planned(PlannedAction{
+		Action: "s3:DeleteObject",
+		Path:   path,
+		Detail: "unlock",
+	}) {
+		return
+	}
+
+	current := r.readLock(options)
+	if current == nil || current.Token != lock.Token {
+		log.Printf("Not removing the lock, as it was taken from us\n")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), LOCK_RELEASE_TIMEOUT)
+	defer cancel()
+
+	panicIf(r.retryContext(ctx, func() error {
+		return r.storage.Delete([]string{path})
+	}, "removing lock"))
+
+	r.emit(Event{Event: "unlocked", Path: path})
+}
+
+// Lock freezes the dest, so deploys and rollbacks fail until it is unlocked (or the lock expires).
+func (c *Client) Lock(ctx context.Context, options Options, reason string) (result *LockResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	lock := r.acquireLock(options, reason, lockTTL(options, 0))
+
+	return &LockResult{r.result(options, "lock", start), lockPath(options), lock}, nil
+}
+
+// Unlock removes the lock of the dest.  Removing a lock held by someone else requires --force-unlock.
+// The result's Lock is the lock which was removed, or nil if the dest wasn't locked.
+func (c *Client) Unlock(ctx context.Context, options Options) (result *LockResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	existing := r.readLock(options)
+	if existing == nil {
+		return &LockResult{r.result(options, "unlock", start), lockPath(options), nil}, nil
+	}
+
+	if existing.Owner != lockOwner() && !existing.expired() && !options.ForceUnlock {
+		panic(lockedError("%s is %s, use --force-unlock to remove it anyway", r.storage.Name()+"/"+lockPath(options), *existing))
+	}
+
+	r.releaseLock(options, existing)
+
+	return &LockResult{r.result(options, "unlock", start), lockPath(options), existing}, nil
+}
@@ -0,0 +1,187 @@
+package deploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/zackbloom/goamz/s3"
+)
+
+// The manifest is stored with the html under the deploy id.  It's named so it won't collide with a
+// file in the project.
+const MANIFEST_NAME = ".stout-manifest.json"
+
+const (
+	MANIFEST_VERSIONED = "versioned"
+	MANIFEST_FILE      = "file"
+	MANIFEST_HTML      = "html"
+)
+
+type ManifestFile struct {
+	Kind         string `json:"kind"`
+	LocalPath    string `json:"localPath"`
+	RemotePath   string `json:"remotePath"`
+	UploadedPath string `json:"uploadedPath"`
+
+	// The hex MD5 of the uploaded (possibly compressed) contents, which is also the ETag S3 gives the
+	// object unless it was uploaded in parts
+	Hash            string `json:"hash"`
+	Size            int64  `json:"size"`
+	ContentType     string `json:"contentType"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	CacheSeconds    int    `json:"cacheSeconds"`
+
+	// Set by the header rules
+	Headers *Headers `json:"headers,omitempty"`
+
+	Variants []ManifestVariant `json:"variants,omitempty"`
+}
+
+// ManifestVariant is a differently encoded version of a file, stored at its path with the encoding's
+// extension (i.e. <uploadedPath>.br)
+type ManifestVariant struct {
+	UploadedPath    string `json:"uploadedPath"`
+	Hash            string `json:"hash"`
+	Size            int64  `json:"size"`
+	ContentEncoding string `json:"contentEncoding"`
+}
+
+type Manifest struct {
+	Id         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Ref        string    `json:"ref,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Dest       string    `json:"dest"`
+	VersionAll bool      `json:"versionAll,omitempty"`
+	Atomic     bool      `json:"atomic,omitempty"`
+
+	// The distribution an atomic deploy was made to, which status and prune ask which deploy is live
+	Distribution string `json:"distribution,omitempty"`
+	Origin       string `json:"origin,omitempty"`
+
+	Files []ManifestFile `json:"files"`
+}
+
+func manifestPath(options Options, id string) string {
+	return joinPath(options.Dest, id, MANIFEST_NAME)
+}
+
+func getUser() string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+func manifestFile(kind string, file FileRef) ManifestFile {
+	variants := make([]ManifestVariant, 0, len(file.Upload.Variants))
+	for _, variant := range file.Upload.Variants {
+		variants = append(variants, ManifestVariant{
+			UploadedPath:    variant.Path,
+			Hash:            variant.Hash,
+			Size:            variant.Size,
+			ContentEncoding: variant.ContentEncoding,
+		})
+	}
+
+	var headers *Headers
+	if !file.Upload.Headers.empty() {
+		headers = &file.Upload.Headers
+	}
+
+	return ManifestFile{
+		Kind:            kind,
+		LocalPath:       file.LocalPath,
+		RemotePath:      strings.TrimPrefix(file.RemotePath, "/"),
+		UploadedPath:    file.UploadedPath,
+		Hash:            file.Upload.Hash,
+		Size:            file.Upload.Size,
+		ContentType:     file.Upload.ContentType,
+		ContentEncoding: file.Upload.ContentEncoding,
+		CacheSeconds:    file.Upload.CacheSeconds,
+		Headers:         headers,
+		Variants:        variants,
+	}
+}
+
+func buildManifest(options Options, id string, versioned []*FileRef, files []*FileRef, htmlFiles []HTMLFile) Manifest {
+	manifest := Manifest{
+		Id:         id,
+		Time:       time.Now().UTC(),
+		Ref:        getRef(),
+		User:       getUser(),
+		Dest:       options.Dest,
+		VersionAll: options.VersionAll,
+		Atomic:     options.Atomic,
+		Files:      make([]ManifestFile, 0, len(versioned)+len(files)+len(htmlFiles)),
+	}
+
+	if options.Atomic {
+		manifest.Distribution = options.Distribution
+		manifest.Origin = options.Origin
+	}
+
+	for _, file := range versioned {
+		manifest.Files = append(manifest.Files, manifestFile(MANIFEST_VERSIONED, *file))
+	}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, manifestFile(MANIFEST_FILE, *file))
+	}
+	for _, file := range htmlFiles {
+		manifest.Files = append(manifest.Files, manifestFile(MANIFEST_HTML, file.File))
+	}
+
+	return manifest
+}
+
+func (r *run) writeManifest(options Options, manifest Manifest) {
+	data := must(json.MarshalIndent(manifest, "", "  ")).([]byte)
+
+	path := manifestPath(options, manifest.Id)
+
+	log.Println("Writing manifest to", path)
+
+	_, err := r.uploadFile(UploadFileRequest{
+		Reader:       strings.NewReader(string(data)),
+		Path:         path,
+		IncludeHash:  false,
+		CacheSeconds: FOREVER,
+
+		// It has who made the deploy, from where, and the paths on their machine
+		Private: true,
+	})
+	panicIf(err)
+}
+
+// readManifest loads the manifest of a deploy, it returns nil if the deploy doesn't have one (it was
+// made before manifests were written, or isn't a deploy at all).
+func (r *run) readManifest(options Options, id string) *Manifest {
+	data, err := r.storage.Get(manifestPath(options, id))
+	if err == ErrNotFound {
+		return nil
+	}
+	// S3 says a missing key is forbidden if we aren't allowed to list the bucket
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == 403 {
+		return nil
+	}
+	panicIf(err)
+
+	// The manifest is stored gzipped, which the http client usually (but not always) undoes for us
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		reader := must(gzip.NewReader(bytes.NewReader(data))).(*gzip.Reader)
+		data = must(ioutil.ReadAll(reader)).([]byte)
+	}
+
+	var manifest Manifest
+	panicIf(json.Unmarshal(data, &manifest))
+
+	return &manifest
+}
@@ -0,0 +1,164 @@
+package deploy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MIME_TYPES is used rather than the system's MIME types, which differ between machines.  Types can be
+// added or overridden with the mimeTypes section of the config.
+var MIME_TYPES = map[string]string{
+	// Text
+	".html":        "text/html",
+	".htm":         "text/html",
+	".css":         "text/css",
+	".js":          "text/javascript",
+	".mjs":         "text/javascript",
+	".json":        "application/json",
+	".map":         "application/json",
+	".jsonld":      "application/ld+json",
+	".webmanifest": "application/manifest+json",
+	".xml":         "application/xml",
+	".rss":         "application/rss+xml",
+	".atom":        "application/atom+xml",
+	".xhtml":       "application/xhtml+xml",
+	".txt":         "text/plain",
+	".md":          "text/markdown",
+	".csv":         "text/csv",
+	".ics":         "text/calendar",
+	".vtt":         "text/vtt",
+	".yaml":        "text/yaml",
+	".yml":         "text/yaml",
+	".appcache":    "text/cache-manifest",
+
+	// Images
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".heic": "image/heic",
+
+	// Fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+
+	// Audio and video
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".opus": "audio/opus",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+
+	// Everything else
+	".wasm": "application/wasm",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".bz2":  "application/x-bzip2",
+	".xz":   "application/x-xz",
+	".7z":   "application/x-7z-compressed",
+	".rar":  "application/x-rar-compressed",
+	".jar":  "application/java-archive",
+	".swf":  "application/x-shockwave-flash",
+}
+
+// The non-text/* types which are text, and should have a charset
+var TEXT_TYPES = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// mimeTypes are the types from the config, by extension, which take precedence over MIME_TYPES
+type mimeTypes map[string]string
+
+func newMimeTypes(o Options) mimeTypes {
+	types := make(mimeTypes)
+	for ext, contentType := range o.MimeTypes {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		types[strings.ToLower(ext)] = contentType
+	}
+	return types
+}
+
+// guess returns the type of a file based on its extension, or an empty string if the extension isn't
+// known.
+func (types mimeTypes) guess(file string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+
+	if contentType, ok := types[ext]; ok {
+		return contentType
+	}
+	return MIME_TYPES[ext]
+}
+
+func isText(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "+json") || strings.HasSuffix(contentType, "+xml") {
+		return true
+	}
+
+	for _, t := range TEXT_TYPES {
+		if contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// withCharset adds a utf-8 charset to text types which don't specify one
+func withCharset(contentType string) string {
+	base := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if isText(base) && !strings.Contains(contentType, "charset=") {
+		return contentType + "; charset=utf-8"
+	}
+	return contentType
+}
+
+// detectContentType decides the Content-Type of a file from its extension or, if the extension isn't
+// known, its contents.
+func detectContentType(types mimeTypes, file string, contents *os.File) string {
+	contentType := types.guess(file)
+
+	if contentType == "" {
+		head := make([]byte, 512)
+		must(contents.Seek(0, os.SEEK_SET))
+		n, _ := contents.Read(head)
+
+		// DetectContentType returns application/octet-stream when it can't tell
+		contentType = http.DetectContentType(head[:n])
+	}
+
+	return withCharset(contentType)
+}
+
+func checkMimeTypes(o Options) {
+	for ext, contentType := range o.MimeTypes {
+		if strings.TrimSpace(contentType) == "" {
+			panic(configError("The MIME type for %s is empty", ext))
+		}
+	}
+}
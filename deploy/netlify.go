@@ -0,0 +1,528 @@
+package deploy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Netlify style config files, which are read from the root of the project rather than being deployed
+const (
+	HEADERS_FILE   = "_headers"
+	REDIRECTS_FILE = "_redirects"
+)
+
+// S3 allows at most 50 routing rules per bucket
+const MAX_ROUTING_RULES = 50
+
+// The routing rules the last deploy to the dest added to the bucket are kept here, so the next deploy
+// only replaces those rules, and doesn't touch the bucket's website configuration if they're unchanged.
+const ROUTING_RULES_NAME = ".stout-routing-rules.json"
+
+func routingRulesPath(options Options) string {
+	return joinPath(options.Dest, ROUTING_RULES_NAME)
+}
+
+// netlifyPattern converts a path from a _headers file into a regexp.  A * (or splat) matches
+// anything, and a :placeholder matches a single segment of the path.
+func netlifyPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "[^/]+"
+			continue
+		}
+
+		parts[i] = strings.Replace(regexp.QuoteMeta(part), `\*`, ".*", -1)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, "/") + "$")
+}
+
+// fileURLs are the paths a file (relative to the root) is served at, including the clean URLs of
+// html files.
+func fileURLs(rel string) []string {
+	file := "/" + filepath.ToSlash(rel)
+	urls := []string{file}
+
+	if path.Base(file) == "index.html" {
+		dir := path.Dir(file)
+		urls = append(urls, dir)
+		if dir != "/" {
+			urls = append(urls, dir+"/")
+		}
+	} else if strings.HasSuffix(file, ".html") {
+		urls = append(urls, strings.TrimSuffix(file, ".html"))
+	}
+
+	return urls
+}
+
+type headerBlock struct {
+	Path    string
+	Pattern *regexp.Regexp
+	Headers Headers
+}
+
+func setHeader(h *Headers, name, value string) {
+	switch strings.ToLower(name) {
+	case "cache-control":
+		h.CacheControl = value
+	case "content-type":
+		h.ContentType = value
+	case "content-disposition":
+		h.ContentDisposition = value
+	case "content-language":
+		h.ContentLanguage = value
+	case "content-encoding", "content-length":
+		log.Printf("Ignoring the %s header in %s, as it is set by Stout\n", name, HEADERS_FILE)
+	default:
+		// S3 can't set arbitrary headers, so they're stored as metadata (x-amz-meta-*) which a CDN
+		// can turn back into headers
+		if h.Meta == nil {
+			h.Meta = make(map[string]string)
+		}
+
+		key := strings.ToLower(name)
+		if h.Meta[key] != "" {
+			value = h.Meta[key] + ", " + value
+		}
+		h.Meta[key] = value
+	}
+}
+
+// parseHeadersFile reads a _headers file: paths (starting at the beginning of a line), each followed
+// by the indented headers which should be set on the files served at it.
+func parseHeadersFile(file string) []headerBlock {
+	handle := must(os.Open(file)).(*os.File)
+	defer handle.Close()
+
+	blocks := make([]headerBlock, 0)
+
+	scanner := bufio.NewScanner(handle)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if trimmed == line {
+			blocks = append(blocks, headerBlock{
+				Path:    trimmed,
+				Pattern: netlifyPattern(trimmed),
+			})
+			continue
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(blocks) == 0 || len(parts) != 2 {
+			panic(configError("Unable to parse line %d of %s: %s", n, file, trimmed))
+		}
+
+		setHeader(&blocks[len(blocks)-1].Headers, strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	panicIf(scanner.Err())
+
+	return blocks
+}
+
+// readNetlifyFiles reads the _headers and _redirects files in the root, if there are any.
+func readNetlifyFiles(options Options) (blocks []headerBlock, redirects []Redirect, hasRedirects bool) {
+	if file := joinPath(options.Root, HEADERS_FILE); isFile(file) {
+		log.Println("Reading headers from", file)
+		blocks = parseHeadersFile(file)
+	}
+
+	if file := joinPath(options.Root, REDIRECTS_FILE); isFile(file) {
+		log.Println("Reading redirects from", file)
+		redirects = parseRedirectsFile(file)
+		hasRedirects = true
+	}
+
+	return
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// ignoreNetlifyFiles removes the _headers and _redirects files from the files being deployed
+func ignoreNetlifyFiles(options Options, files []*FileRef) []*FileRef {
+	return ignoreFiles(files, []*FileRef{
+		{LocalPath: joinPath(options.Root, HEADERS_FILE)},
+		{LocalPath: joinPath(options.Root, REDIRECTS_FILE)},
+	})
+}
+
+// relativePaths are the paths of the files, relative to the root
+func relativePaths(options Options, lists ...[]*FileRef) []string {
+	paths := make([]string, 0)
+	for _, files := range lists {
+		for _, file := range files {
+			paths = append(paths, mustString(filepath.Rel(options.Root, file.LocalPath)))
+		}
+	}
+	return paths
+}
+
+// escapeGlob escapes the characters path.Match would otherwise treat as a pattern
+func escapeGlob(p string) string {
+	var out []rune
+	for _, c := range p {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			out = append(out, '\\')
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// headersFileRules converts the blocks of a _headers file into header rules for each of the files
+// (relative to the root) they apply to.
+func headersFileRules(blocks []headerBlock, files []string) HeaderRules {
+	rules := make(HeaderRules)
+
+	for _, file := range files {
+		var headers Headers
+		matched := false
+
+		for _, block := range blocks {
+			for _, u := range fileURLs(file) {
+				if block.Pattern.MatchString(u) {
+					headers = headers.merge(block.Headers)
+					matched = true
+					break
+				}
+			}
+		}
+
+		if matched {
+			// The leading ./ makes the rule match the whole path, not just the name of the file
+			rules["./"+escapeGlob(filepath.ToSlash(file))] = headers
+		}
+	}
+
+	return rules
+}
+
+type Redirect struct {
+	From   string
+	To     string
+	Status int
+	Force  bool
+}
+
+// parseRedirectsFile reads a _redirects file, each line of which is a path, the URL it should
+// redirect to and optionally the status code (with a ! if it should apply even when a file exists).
+func parseRedirectsFile(file string) []Redirect {
+	handle := must(os.Open(file)).(*os.File)
+	defer handle.Close()
+
+	redirects := make([]Redirect, 0)
+
+	scanner := bufio.NewScanner(handle)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			panic(configError("Unable to parse line %d of %s: %s", n, file, line))
+		}
+
+		redirect := Redirect{
+			From:   fields[0],
+			To:     fields[1],
+			Status: 301,
+		}
+
+		if len(fields) > 2 {
+			code := fields[2]
+			if strings.HasSuffix(code, "!") {
+				redirect.Force = true
+				code = strings.TrimSuffix(code, "!")
+			}
+
+			status, err := strconv.Atoi(code)
+			if err != nil || len(fields) > 3 {
+				log.Printf("Skipping line %d of %s, query and condition matching isn't supported on S3: %s\n", n, file, line)
+				continue
+			}
+			redirect.Status = status
+		}
+
+		redirects = append(redirects, redirect)
+	}
+	panicIf(scanner.Err())
+
+	return redirects
+}
+
+// redirectKey is the object a path is served from, relative to the bucket
+func redirectKey(options Options, p string) string {
+	key := destPrefix(options) + strings.TrimPrefix(p, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "index.html"
+	}
+	return key
+}
+
+func isExternal(to string) bool {
+	return strings.HasPrefix(to, "http://") || strings.HasPrefix(to, "https://")
+}
+
+// RedirectObject is an empty object S3 redirects (with a 301) to Location
+type RedirectObject struct {
+	Key      string
+	Location string
+}
+
+// translateRedirects converts redirects into the S3 equivalents.  A 301 from a single path is stored as
+// a redirect object, redirects from a path ending in * become routing rules on the bucket.  Routing rules
+// match every key starting with their path, so other codes from a single path can't be made with one.
+// Those, rewrites (200s), custom 404s and placeholders have no S3 equivalent and are skipped.  Unless forced, redirects from a path a file
+// is being deployed to are skipped, as the file takes precedence.
+func translateRedirects(options Options, redirects []Redirect, deployed map[string]bool) (objects []RedirectObject, rules []routingRule) {
+	objects = make([]RedirectObject, 0)
+	rules = make([]routingRule, 0)
+
+	for _, redirect := range redirects {
+		switch redirect.Status {
+		case 301, 302, 303, 307, 308:
+		default:
+			log.Printf("Skipping redirect from %s, only redirects (not %d responses) are supported on S3\n", redirect.From, redirect.Status)
+			continue
+		}
+
+		if strings.Contains(redirect.From, "/:") || (strings.Contains(redirect.To, "/:") && !strings.HasSuffix(redirect.To, ":splat")) {
+			log.Printf("Skipping redirect from %s, placeholders aren't supported on S3\n", redirect.From)
+			continue
+		}
+
+		splat := strings.HasSuffix(redirect.From, "*")
+		if strings.Contains(strings.TrimSuffix(redirect.From, "*"), "*") {
+			log.Printf("Skipping redirect from %s, a * is only supported at the end of the path on S3\n", redirect.From)
+			continue
+		}
+
+		if !splat {
+			key := redirectKey(options, redirect.From)
+
+			if deployed[key] && !redirect.Force {
+				log.Printf("Skipping redirect from %s, as a file is being deployed to it (add a ! to its status to override it)\n", redirect.From)
+				continue
+			}
+
+			if redirect.Status != 301 {
+				log.Printf("Skipping redirect from %s, S3 can only redirect a single path with a 301 (not a %d)\n", redirect.From, redirect.Status)
+				continue
+			}
+
+			location := redirect.To
+			if !isExternal(location) {
+				location = "/" + destPrefix(options) + strings.TrimPrefix(location, "/")
+			}
+
+			objects = append(objects, RedirectObject{Key: key, Location: location})
+			continue
+		}
+
+		rule := routingRule{
+			ConditionKeyPrefixEquals: destPrefix(options) + strings.TrimPrefix(strings.TrimSuffix(redirect.From, "*"), "/"),
+			RedirectHttpRedirectCode: strconv.Itoa(redirect.Status),
+		}
+
+		to := redirect.To
+		if isExternal(to) {
+			parsed := must(url.Parse(to)).(*url.URL)
+
+			rule.RedirectProtocol = parsed.Scheme
+			rule.RedirectHostName = parsed.Host
+			to = parsed.Path
+		} else {
+			to = destPrefix(options) + strings.TrimPrefix(to, "/")
+		}
+
+		if strings.HasSuffix(to, ":splat") {
+			rule.RedirectReplaceKeyPrefixWith = strings.TrimPrefix(strings.TrimSuffix(to, ":splat"), "/")
+		} else {
+			rule.RedirectReplaceKeyWith = strings.TrimPrefix(to, "/")
+			if rule.RedirectReplaceKeyWith == "" || strings.HasSuffix(rule.RedirectReplaceKeyWith, "/") {
+				rule.RedirectReplaceKeyWith += "index.html"
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if len(rules) > MAX_ROUTING_RULES {
+		panic(configError("%s needs %d routing rules, but S3 only allows %d per bucket", REDIRECTS_FILE, len(rules), MAX_ROUTING_RULES))
+	}
+
+	return
+}
+
+// putRedirect writes an empty object which is served as a redirect to location.
+func (r *run) putRedirect(redirect RedirectObject) {
+	obj := Object{
+		Key:              redirect.Key,
+		ContentType:      "text/html; charset=utf-8",
+		CacheControl:     fmt.Sprintf("public, max-age=%d", LIMITED),
+		RedirectLocation: redirect.Location,
+	}
+
+	if remote, err := r.storage.Head(redirect.Key); err == nil && remote.RedirectLocation == redirect.Location {
+		log.Printf("Skipping redirect from %s to %s, it hasn't changed\n", redirect.Key, redirect.Location)
+		return
+	}
+
+	if r.planned(PlannedAction{
+		Action:       "s3:PutObject",
+		Path:         redirect.Key,
+		CacheControl: obj.CacheControl,
+		Detail:       "redirect to " + redirect.Location,
+	}) {
+		return
+	}
+
+	log.Printf("Redirecting %s to %s\n", redirect.Key, redirect.Location)
+
+	panicIf(r.retry(func() error {
+		return r.storage.Put(obj, strings.NewReader(""))
+	}, "writing redirect"))
+
+	r.emit(Event{Event: "redirected", Path: redirect.Key, Detail: redirect.Location})
+}
+
+// readRoutingRules returns the routing rules the last deploy to the dest added
+func (r *run) readRoutingRules(options Options) []routingRule {
+	rules := make([]routingRule, 0)
+
+	data, err := r.storage.Get(routingRulesPath(options))
+	if err == ErrNotFound {
+		return rules
+	}
+	panicIf(err)
+
+	panicIf(json.Unmarshal(data, &rules))
+	return rules
+}
+
+func (r *run) writeRoutingRules(options Options, rules []routingRule) {
+	path := routingRulesPath(options)
+
+	if r.planned(PlannedAction{
+		Action: "s3:PutObject",
+		Path:   path,
+		Detail: fmt.Sprintf("%d routing rules", len(rules)),
+	}) {
+		return
+	}
+
+	data := must(json.MarshalIndent(rules, "", "  ")).([]byte)
+
+	panicIf(r.retry(func() error {
+		return r.storage.Put(Object{
+			Key:          path,
+			Size:         int64(len(data)),
+			ContentType:  "application/json",
+			CacheControl: "no-cache",
+			Private:      true,
+		}, strings.NewReader(string(data)))
+	}, "writing routing rules"))
+}
+
+func containsRule(rules []routingRule, rule routingRule) bool {
+	for _, other := range rules {
+		if reflect.DeepEqual(other, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// putRoutingRules replaces the routing rules the last deploy to the dest added with rules, leaving the
+// rest of the bucket's website configuration (including rules added by hand or for other dests) alone.
+func (r *run) putRoutingRules(options Options, rules []routingRule) {
+	storage, isS3 := r.storage.(*S3Storage)
+	if !isS3 {
+		if len(rules) != 0 {
+			log.Printf("Skipping %d redirects which need routing rules, as they are only supported by S3\n", len(rules))
+		}
+		return
+	}
+	bucket := storage.Bucket
+
+	previous := r.readRoutingRules(options)
+	if reflect.DeepEqual(previous, rules) {
+		return
+	}
+
+	config, err := getBucketWebsite(bucket)
+	if err != nil {
+		panic(wrapError(err, "Unable to read the website configuration of %s, which is needed to add the redirects in %s", options.Bucket, REDIRECTS_FILE))
+	}
+
+	existing := make([]routingRule, 0)
+	if config.RoutingRules != nil {
+		existing = *config.RoutingRules
+	}
+
+	updated := make([]routingRule, 0, len(existing)+len(rules))
+	for _, rule := range existing {
+		if !containsRule(previous, rule) && !containsRule(rules, rule) {
+			updated = append(updated, rule)
+		}
+	}
+	updated = append(updated, rules...)
+
+	if reflect.DeepEqual(existing, updated) {
+		r.writeRoutingRules(options, rules)
+		return
+	}
+
+	if len(updated) > MAX_ROUTING_RULES {
+		panic(configError("The bucket would have %d routing rules, but S3 only allows %d", len(updated), MAX_ROUTING_RULES))
+	}
+
+	config.RoutingRules = &updated
+	if len(updated) == 0 {
+		config.RoutingRules = nil
+	}
+
+	if !r.planned(PlannedAction{
+		Action: "s3:PutBucketWebsite",
+		Path:   options.Bucket,
+		Detail: fmt.Sprintf("%d routing rules", len(updated)),
+	}) {
+		log.Printf("Updating the routing rules of %s (%d rules)\n", options.Bucket, len(updated))
+
+		panicIf(putBucketWebsite(bucket, *config))
+	}
+
+	r.writeRoutingRules(options, rules)
+}
+
+// deployRedirects makes the redirects live, after the rest of the deploy
+func (r *run) deployRedirects(options Options, objects []RedirectObject, rules []routingRule) {
+	for _, redirect := range objects {
+		r.putRedirect(redirect)
+	}
+
+	r.putRoutingRules(options, rules)
+}
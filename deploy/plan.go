@@ -0,0 +1,38 @@
+package deploy
+
+import (
+	"sync"
+)
+
+// A PlannedAction is a mutating request which would have been made, if this wasn't a dry run.  Action
+// is named after the AWS API call (s3:PutObject, iam:CreateUser, etc.).
+type PlannedAction struct {
+	Action          string `json:"action"`
+	Path            string `json:"path,omitempty"`
+	From            string `json:"from,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	CacheControl    string `json:"cacheControl,omitempty"`
+	Detail          string `json:"detail,omitempty"`
+}
+
+type Plan struct {
+	sync.Mutex
+	Actions []PlannedAction
+}
+
+// When --dry-run is used, every request which would change something is recorded in the plan instead
+// of being made.  planned records the action if this is a dry run, returning true if the caller should
+// skip it.
+func (r *run) planned(action PlannedAction) bool {
+	if r.plan == nil {
+		return false
+	}
+
+	r.plan.Lock()
+	defer r.plan.Unlock()
+
+	r.plan.Actions = append(r.plan.Actions, action)
+	return true
+}
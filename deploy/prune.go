@@ -0,0 +1,233 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versioned files are uploaded to the root of the dest with a 12 character hash prefix
+var hashedAssetRe = regexp.MustCompile("^[0-9a-f]{12}_")
+
+// Files uploaded more recently than this are never deleted, as they might belong to a deploy which
+// is still in progress (and hasn't written its manifest yet).
+const PRUNE_GRACE = time.Hour
+
+func parseAge(age string) time.Duration {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(age[:len(age)-1])
+		if err != nil {
+			panic(configError("Invalid duration %s", age))
+		}
+		return time.Duration(days) * 24 * time.Hour
+	}
+
+	duration, err := time.ParseDuration(age)
+	if err != nil {
+		panic(configError("Invalid duration %s", age))
+	}
+	return duration
+}
+
+// FormatBytes formats a size for people, i.e. 1.5 MB
+func FormatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+func hasDeploy(deploys []DeployInfo, id string) bool {
+	for _, deploy := range deploys {
+		if id != "" && deploy.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedDeploys decides which deploys are kept: the live and pinned deploys, the newest options.Keep
+// deploys, anything newer than options.KeepSince and any deploy without a manifest, as we can't tell
+// when it was made.
+func (r *run) retainedDeploys(options Options, deploys []DeployInfo) map[string]bool {
+	keep := make(map[string]bool)
+
+	if atomic, ok := atomicOptions(options, deploys); ok {
+		// Pruning the deploy the distribution serves would take the whole site down
+		live := r.liveDeployId(atomic)
+		if !hasDeploy(deploys, live) {
+			panic(newError(EXIT_ERROR, "Unable to tell which deploy distribution %s is serving, so nothing was pruned", atomic.Distribution))
+		}
+		keep[live] = true
+	} else {
+		for _, page := range r.pageStatus(options, deploys) {
+			if page.Id != "" {
+				keep[page.Id] = true
+			}
+		}
+	}
+
+	for _, id := range strings.Split(options.Pin, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			keep[id] = true
+		}
+	}
+
+	var since time.Time
+	if options.KeepSince != "" {
+		since = time.Now().Add(-parseAge(options.KeepSince))
+	}
+
+	count := 0
+	for _, deploy := range deploys {
+		if deploy.Manifest == nil {
+			keep[deploy.Id] = true
+			continue
+		}
+
+		if count < options.Keep {
+			keep[deploy.Id] = true
+		}
+		if !since.IsZero() && deploy.Time.After(since) {
+			keep[deploy.Id] = true
+		}
+
+		count++
+	}
+
+	return keep
+}
+
+func isRecent(key Object) bool {
+	if key.LastModified.IsZero() {
+		return true
+	}
+
+	return time.Since(key.LastModified) < PRUNE_GRACE
+}
+
+func (r *run) deleteKeys(keys []Object) {
+	if r.plan != nil {
+		for _, key := range keys {
+			r.planned(PlannedAction{Action: "s3:DeleteObject", Path: key.Key, Size: key.Size})
+		}
+		return
+	}
+
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		paths = append(paths, key.Key)
+	}
+
+	panicIf(r.storage.Delete(paths))
+
+	for _, key := range keys {
+		r.emit(Event{Event: "deleted", Path: key.Key, Size: key.Size})
+	}
+}
+
+// Prune deletes old deploys, and the versioned files only they use.
+func (c *Client) Prune(ctx context.Context, options Options) (result *PruneResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	if options.Keep <= 0 && options.KeepSince == "" {
+		return nil, configError("You must specify how many deploys to keep with --keep, --keep-since or both")
+	}
+
+	deploys := r.listDeploys(options)
+	keep := r.retainedDeploys(options, deploys)
+
+	legacy := 0
+	referenced := make(map[string]bool)
+	for _, deploy := range deploys {
+		if !keep[deploy.Id] {
+			continue
+		}
+
+		if deploy.Manifest == nil {
+			legacy++
+			continue
+		}
+
+		for _, file := range deploy.Manifest.Files {
+			if file.Kind == MANIFEST_VERSIONED {
+				referenced[file.UploadedPath] = true
+
+				for _, variant := range file.Variants {
+					referenced[variant.UploadedPath] = true
+				}
+			}
+		}
+	}
+
+	prefix := destPrefix(options)
+	keys, _ := r.listAll(prefix, "")
+
+	deployKeys := make(map[string][]Object)
+	assets := make([]Object, 0)
+	for _, key := range keys {
+		rel := key.Key[len(prefix):]
+
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) == 2 {
+			deployKeys[parts[0]] = append(deployKeys[parts[0]], key)
+		}
+
+		if hashedAssetRe.MatchString(rel) && !referenced[key.Key] && !isRecent(key) {
+			assets = append(assets, key)
+		}
+	}
+
+	toDelete := make([]Object, 0)
+	var size int64
+
+	pruned := 0
+	for _, deploy := range deploys {
+		if keep[deploy.Id] {
+			continue
+		}
+
+		var deploySize int64
+		for _, key := range deployKeys[deploy.Id] {
+			deploySize += key.Size
+		}
+
+		log.Printf("Pruning deploy %s from %s (%d files, %s)\n", deploy.Id, deploy.Time.Local().Format("2006-01-02 15:04:05 MST"), len(deployKeys[deploy.Id]), FormatBytes(deploySize))
+
+		toDelete = append(toDelete, deployKeys[deploy.Id]...)
+		size += deploySize
+		pruned++
+	}
+
+	if legacy != 0 {
+		log.Printf("Not pruning versioned files, as %d of the deploys being kept were made without a manifest, so we can't tell which files they use\n", legacy)
+	} else {
+		for _, key := range assets {
+			log.Printf("Pruning unreferenced file %s (%s)\n", key.Key, FormatBytes(key.Size))
+
+			toDelete = append(toDelete, key)
+			size += key.Size
+		}
+	}
+
+	r.deleteKeys(toDelete)
+
+	return &PruneResult{r.result(options, "prune", start), pruned, len(toDelete), size}, nil
+}
@@ -0,0 +1,349 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rollback makes an earlier deploy live again.  The error is a *PartialError if some of its files couldn't
+// be restored, running it again retries every file.
+func (c *Client) Rollback(ctx context.Context, options Options, version string) (result *RollbackResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	if version == "" {
+		return nil, configError("You must specify a version to rollback to")
+	}
+	if options.RedirectNewPages != "" && !strings.HasPrefix(options.RedirectNewPages, "/") && !isExternal(options.RedirectNewPages) {
+		return nil, configError("--redirect-new-pages must be an absolute path or url")
+	}
+
+	if options.Lock {
+		lock := r.acquireLock(options, "rolling back to "+version, lockTTL(options, DEFAULT_LOCK_TTL))
+		defer r.releaseLock(options, lock)
+	} else {
+		r.checkLock(options)
+	}
+
+	// A site deployed atomically has to be rolled back the same way, even without --atomic
+	if atomic, ok := atomicOptions(options, r.listDeploys(options)); ok {
+		r.rollbackAtomic(atomic, version)
+		return &RollbackResult{Result: r.result(options, "rollback", start), Id: version}, nil
+	}
+
+	// List files with the correct prefix in the storage
+	// Remove their prefix with a copy.
+
+	prefix := destPrefix(options) + version + "/"
+
+	keys, _ := r.listAll(prefix, "")
+	if len(keys) == 0 {
+		return nil, newError(EXIT_NOT_FOUND, "A deploy with the provided id (%s) was not found in %s", version, r.storage.Name())
+	}
+
+	manifest := r.readManifest(options, version)
+
+	var added []Object
+	if options.RemoveNewPages || options.RedirectNewPages != "" {
+		added = r.newPages(options, version, manifest, keys)
+		r.confirmNewPages(options, added)
+	}
+
+	// The manifest tells us the headers each file was uploaded with, deploys without one have
+	// their files checked with a HEAD request.
+	headers := make(map[string]ManifestFile)
+	if manifest != nil {
+		for _, file := range manifest.Files {
+			headers[strings.TrimPrefix(file.UploadedPath, "/")] = file
+
+			for _, variant := range file.Variants {
+				headers[strings.TrimPrefix(variant.UploadedPath, "/")] = ManifestFile{
+					ContentType:     file.ContentType,
+					ContentEncoding: variant.ContentEncoding,
+					Headers:         file.Headers,
+				}
+			}
+		}
+	}
+
+	ch := make(chan Object)
+	errs := r.newFileErrors()
+
+	var restored int32
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < UPLOAD_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for key := range ch {
+				if err := r.restoreFile(options, version, prefix, key, headers); err != nil {
+					log.Printf("Error restoring %s: %s", key.Key, err)
+					errs.add(key.Key, err)
+				} else {
+					atomic.AddInt32(&restored, 1)
+				}
+			}
+		}()
+	}
+
+	total := 0
+	for _, key := range keys {
+		if r.cancelled() {
+			break
+		}
+		if key.Key == prefix+MANIFEST_NAME {
+			continue
+		}
+
+		ch <- key
+		total++
+	}
+
+	close(ch)
+
+	wg.Wait()
+
+	panicIf(r.ctx.Err())
+
+	failed := errs.count()
+
+	// The pages are only removed once the old pages they might link to are back in place
+	if failed == 0 {
+		r.removeNewPages(options, added)
+	}
+
+	if !options.DryRun {
+		log.Printf("Reverted %d files to version %s, %d failed", restored, version, failed)
+		if len(added) != 0 && failed == 0 {
+			if options.RedirectNewPages != "" {
+				log.Printf("Redirected %d pages which were added after version %s to %s", len(added), version, options.RedirectNewPages)
+			} else {
+				log.Printf("Deleted %d pages which were added after version %s", len(added), version)
+			}
+		}
+	}
+
+	// Running the rollback again retries every file
+	if err := errs.err("restore", total); err != nil {
+		return nil, err
+	}
+
+	return &RollbackResult{r.result(options, "rollback", start), version, int(restored), len(added)}, nil
+}
+
+// restoreFile copies one file of a deploy to its live path.  Failures are returned rather than stopping
+// the rollback, so we can tell the user how many files were and weren't restored.
+func (r *run) restoreFile(options Options, version, prefix string, key Object, headers map[string]ManifestFile) (err error) {
+	defer recoverError(&err)
+
+	path := key.Key
+
+	newPath := joinPath(destPrefix(options), path[len(prefix):])
+
+	// Only html files are stored under the deploy id unless the deploy was made with
+	// --version-all, in which case every file is restored.
+	uploaded, found := headers[path]
+	if !found {
+		uploaded = r.remoteHeaders(path)
+
+		if filepath.Ext(path) == ".html" {
+			uploaded.ContentType = "text/html; charset=utf-8"
+		}
+	}
+
+	var extra Headers
+	if uploaded.Headers != nil {
+		extra = *uploaded.Headers
+	}
+
+	log.Printf("Aliasing %s to %s", path, newPath)
+
+	r.copyFile(path, newPath, uploaded.ContentType, uploaded.ContentEncoding, extra, version)
+
+	r.emit(Event{Event: "restored", Path: newPath, From: path})
+	return nil
+}
+
+// newPages finds the live html pages which aren't part of the deploy being rolled back to, as they were
+// added by a later deploy.  The deploy's manifest lists its pages, deploys without one are assumed to
+// have the pages stored under their id.  Only pages one of this dest's deploys made live are removed,
+// anything else in the bucket (including the pages of another dest nested inside this one) is left alone.
+func (r *run) newPages(options Options, version string, manifest *Manifest, keys []Object) []Object {
+	prefix := destPrefix(options)
+
+	pages := make(map[string]bool)
+	if manifest != nil {
+		for _, file := range manifest.Files {
+			if file.Kind == MANIFEST_HTML {
+				pages[strings.TrimPrefix(file.RemotePath, "/")] = true
+			}
+		}
+	} else {
+		for _, key := range keys {
+			if filepath.Ext(key.Key) == ".html" {
+				pages[prefix+key.Key[len(prefix+version+"/"):]] = true
+			}
+		}
+	}
+
+	// The pages any of our deploys put live
+	deploys := make(map[string]*DeployInfo)
+	ours := make(map[string]bool)
+	for _, deploy := range r.listDeploys(options) {
+		deploy := deploy
+		deploys[deploy.Id] = &deploy
+
+		if deploy.Manifest != nil {
+			for _, file := range deploy.Manifest.Files {
+				if file.Kind == MANIFEST_HTML {
+					ours[strings.TrimPrefix(file.RemotePath, "/")] = true
+				}
+			}
+		}
+	}
+
+	live, _ := r.listAll(prefix, "")
+
+	// A manifest which isn't directly under one of our deploy ids belongs to a dest nested in this one
+	nested := make([]string, 0)
+	for _, key := range live {
+		rel := key.Key[len(prefix):]
+		parts := strings.SplitN(rel, "/", 2)
+
+		if strings.HasSuffix(rel, "/"+MANIFEST_NAME) {
+			dir := strings.TrimSuffix(rel, "/"+MANIFEST_NAME)
+			if i := strings.LastIndex(dir, "/"); i != -1 {
+				nested = append(nested, prefix+dir[:i+1])
+			}
+		} else if deploy := deploys[parts[0]]; deploy != nil && deploy.Manifest == nil && len(parts) == 2 {
+			ours[prefix+parts[1]] = true
+		}
+	}
+
+	added := make([]Object, 0)
+	for _, key := range live {
+		if filepath.Ext(key.Key) != ".html" || pages[key.Key] {
+			continue
+		}
+
+		rel := key.Key[len(prefix):]
+		if parts := strings.SplitN(rel, "/", 2); len(parts) == 2 && deploys[parts[0]] != nil {
+			continue
+		}
+
+		if hasAnyPrefix(key.Key, nested) {
+			continue
+		}
+
+		if !ours[key.Key] {
+			// Pages we copied live are tagged with the deploy they came from
+			remote, err := r.storage.Head(key.Key)
+			if err != nil || deploys[remote.Meta[DEPLOY_META]] == nil {
+				continue
+			}
+		}
+
+		added = append(added, key)
+	}
+
+	return added
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmNewPages lists the pages which will be removed, and asks Client.Confirm if they should be.  Dry
+// runs and --yes skip the question.
+func (r *run) confirmNewPages(options Options, added []Object) {
+	if len(added) == 0 {
+		return
+	}
+
+	action := "deleted"
+	if options.RedirectNewPages != "" {
+		action = "redirected to " + options.RedirectNewPages
+	}
+
+	log.Printf("%d pages were added after this deploy, and will be %s:\n", len(added), action)
+	for _, key := range added {
+		log.Printf("  %s\n", key.Key)
+	}
+
+	if options.DryRun || options.Yes {
+		return
+	}
+
+	if r.Confirm == nil {
+		panic(configError("Pass --yes to remove the pages added after the deploy without being asked"))
+	}
+
+	if !r.Confirm(fmt.Sprintf("%d pages will be %s, continue?", len(added), action)) {
+		panic(newError(EXIT_CANCELLED, "Rollback cancelled"))
+	}
+}
+
+// removeNewPages deletes the pages added after the deploy, or replaces them with redirects if
+// --redirect-new-pages was given.
+func (r *run) removeNewPages(options Options, added []Object) {
+	if options.RedirectNewPages == "" {
+		r.deleteKeys(added)
+		return
+	}
+
+	for _, key := range added {
+		r.putRedirect(RedirectObject{
+			Key:      key.Key,
+			Location: options.RedirectNewPages,
+		})
+	}
+}
+
+// rollbackAtomic points the distribution back at an earlier deploy, which switches every page at once.
+func (r *run) rollbackAtomic(options Options, version string) {
+	checkAtomic(options)
+
+	manifest := r.readManifest(options, version)
+	if manifest == nil || !manifest.Atomic {
+		panic(configError("The deploy %s wasn't made with --atomic, so it can't be rolled back to atomically", version))
+	}
+
+	r.setOriginPath(options, version)
+
+	if !options.DryRun {
+		log.Printf("Pointed distribution %s at version %s", options.Distribution, version)
+	}
+}
+
+// remoteHeaders gets the headers of an object which isn't in a manifest.
+func (r *run) remoteHeaders(path string) ManifestFile {
+	var remote *Object
+	panicIf(r.retry(func() (err error) {
+		remote, err = r.storage.Head(path)
+		return
+	}, "reading headers of "+path))
+
+	return ManifestFile{
+		ContentType:     remote.ContentType,
+		ContentEncoding: remote.ContentEncoding,
+		Headers: &Headers{
+			ContentDisposition: remote.ContentDisposition,
+			ContentLanguage:    remote.ContentLanguage,
+		},
+	}
+}
@@ -0,0 +1,143 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zackbloom/goamz/aws"
+	"github.com/zackbloom/goamz/s3"
+)
+
+// The requests goamz can't make for us: uploads with headers its Options don't include (Content-Language)
+// and website configurations with the parts of a routing rule its RoutingRule leaves out.  They're sent
+// to a URL goamz presigns, so they're signed the same way as the rest of its requests.
+
+// How long the URLs of our own requests are signed for, they're used immediately
+const S3_SIGNED_URL_EXPIRY = 15 * time.Minute
+
+// routingRule is a routing rule of an S3 website, the JSON of its fields is what we record the rules we
+// added in.
+type routingRule struct {
+	ConditionKeyPrefixEquals     string `xml:"Condition>KeyPrefixEquals"`
+	RedirectProtocol             string `xml:"Redirect>Protocol,omitempty"`
+	RedirectHostName             string `xml:"Redirect>HostName,omitempty"`
+	RedirectReplaceKeyPrefixWith string `xml:"Redirect>ReplaceKeyPrefixWith,omitempty"`
+	RedirectReplaceKeyWith       string `xml:"Redirect>ReplaceKeyWith,omitempty"`
+	RedirectHttpRedirectCode     string `xml:"Redirect>HttpRedirectCode,omitempty"`
+}
+
+type websiteConfiguration struct {
+	XMLName               xml.Name                  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ WebsiteConfiguration"`
+	IndexDocument         *s3.IndexDocument         `xml:"IndexDocument,omitempty"`
+	ErrorDocument         *s3.ErrorDocument         `xml:"ErrorDocument,omitempty"`
+	RoutingRules          *[]routingRule            `xml:"RoutingRules>RoutingRule,omitempty"`
+	RedirectAllRequestsTo *s3.RedirectAllRequestsTo `xml:"RedirectAllRequestsTo,omitempty"`
+}
+
+// isSignedHeader is true of the headers S3's V2 signatures cover, the ones which have to be given to
+// goamz when it signs the URL
+func isSignedHeader(name string) bool {
+	name = strings.ToLower(name)
+	return name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-")
+}
+
+// s3Request sends a request for key to a URL signed by goamz, returning the body of the response.  S3
+// can report an error with a 200 response to a copy, so a body which is an error is one too.
+func s3Request(bucket *s3.Bucket, method, key string, params url.Values, headers http.Header, body io.Reader, length int64) (data []byte, err error) {
+	defer recoverError(&err)
+
+	if bucket.S3.Signature == aws.V2Signature && bucket.S3.Auth.Token() != "" {
+		headers.Set("X-Amz-Security-Token", bucket.S3.Auth.Token())
+	}
+
+	signed := make(http.Header)
+	for name, values := range headers {
+		if isSignedHeader(name) {
+			signed[name] = values
+		}
+	}
+
+	query := make(url.Values)
+	for name, values := range params {
+		query[name] = values
+	}
+
+	// SignedURLWithMethod panics if the URL can't be built
+	signedURL := bucket.SignedURLWithMethod(method, key, time.Now().Add(S3_SIGNED_URL_EXPIRY), query, signed)
+
+	if length == 0 {
+		body = nil
+	}
+
+	req := must(http.NewRequest(method, signedURL, body)).(*http.Request)
+	req.ContentLength = length
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	panicIf(err)
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+	panicIf(err)
+
+	if resp.StatusCode >= 300 || isErrorDocument(data) {
+		s3Err := &s3.Error{}
+		xml.Unmarshal(data, s3Err)
+
+		s3Err.StatusCode = resp.StatusCode
+		if s3Err.Message == "" {
+			s3Err.Message = resp.Status
+		}
+		return nil, s3Err
+	}
+
+	return data, nil
+}
+
+// isErrorDocument is true if the XML in data is an S3 error
+func isErrorDocument(data []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "Error"
+		}
+	}
+}
+
+// getBucketWebsite returns the website configuration of the bucket
+func getBucketWebsite(bucket *s3.Bucket) (*websiteConfiguration, error) {
+	data, err := s3Request(bucket, "GET", "/", url.Values{"website": {""}}, make(http.Header), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var config websiteConfiguration
+	if err := xml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// putBucketWebsite replaces the website configuration of the bucket
+func putBucketWebsite(bucket *s3.Bucket, config websiteConfiguration) error {
+	doc, err := xml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	doc = append([]byte(xml.Header), doc...)
+
+	_, err = s3Request(bucket, "PUT", "/", url.Values{"website": {""}}, make(http.Header), bytes.NewReader(doc), int64(len(doc)))
+	return err
+}
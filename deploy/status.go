@@ -0,0 +1,154 @@
+package deploy
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type PageStatus struct {
+	Path string `json:"path"`
+
+	// Empty if the page doesn't match any deploy
+	Id string `json:"id"`
+
+	// Where the page redirects to, if it's a redirect (written by _redirects or a rollback with
+	// --redirect-new-pages) rather than a deployed page
+	Redirect string `json:"redirect,omitempty"`
+}
+
+type SiteStatus struct {
+	Pages []PageStatus `json:"pages"`
+
+	// The deploys serving the pages, the site is only mixed if there's more than one.  Redirects and
+	// pages which don't match any deploy are listed on their own instead.
+	Deploys   []string `json:"deploys"`
+	Mixed     bool     `json:"mixed"`
+	Redirects []string `json:"redirects"`
+	Unknown   []string `json:"unknown"`
+}
+
+// pageStatus works out which deploy each live html page under the dest is being served from.  Each
+// page's ETag is compared with the copies of that page under each deploy id.  If more than one deploy
+// uploaded identical html we use the deploy id the live copy was tagged with, or failing that the
+// newest deploy (deploys is expected to be sorted newest first).
+func (r *run) pageStatus(options Options, deploys []DeployInfo) []PageStatus {
+	if atomic, ok := atomicOptions(options, deploys); ok {
+		return r.atomicPageStatus(atomic, deploys)
+	}
+
+	prefix := destPrefix(options)
+	keys, _ := r.listAll(prefix, "")
+
+	order := make(map[string]int)
+	for i, deploy := range deploys {
+		order[deploy.Id] = i
+	}
+
+	// page path -> etag -> deploy ids, in the order of deploys
+	copies := make(map[string]map[string][]string)
+	live := make([]string, 0)
+	etags := make(map[string]string)
+
+	for _, key := range keys {
+		if filepath.Ext(key.Key) != ".html" {
+			continue
+		}
+
+		rel := key.Key[len(prefix):]
+		etag := key.ETag
+
+		parts := strings.SplitN(rel, "/", 2)
+		if _, isDeploy := order[parts[0]]; isDeploy && len(parts) == 2 {
+			page := parts[1]
+			if copies[page] == nil {
+				copies[page] = make(map[string][]string)
+			}
+			copies[page][etag] = append(copies[page][etag], parts[0])
+			continue
+		}
+
+		live = append(live, rel)
+		etags[rel] = etag
+	}
+
+	pages := make([]PageStatus, 0, len(live))
+	for _, page := range live {
+		matches := copies[page][etags[page]]
+
+		status := PageStatus{
+			Path: prefix + page,
+		}
+
+		if len(matches) > 1 {
+			remote, err := r.storage.Head(prefix + page)
+			if err == nil {
+				tagged := remote.Meta[DEPLOY_META]
+				for _, id := range matches {
+					if id == tagged {
+						status.Id = id
+					}
+				}
+			}
+		}
+
+		if status.Id == "" {
+			for _, id := range matches {
+				if status.Id == "" || order[id] < order[status.Id] {
+					status.Id = id
+				}
+			}
+		}
+
+		if len(matches) == 0 {
+			if remote, err := r.storage.Head(prefix + page); err == nil {
+				status.Redirect = remote.RedirectLocation
+			}
+		}
+
+		pages = append(pages, status)
+	}
+
+	return pages
+}
+
+func (r *run) siteStatus(options Options) SiteStatus {
+	pages := r.pageStatus(options, r.listDeploys(options))
+
+	status := SiteStatus{
+		Pages:     pages,
+		Deploys:   make([]string, 0),
+		Redirects: make([]string, 0),
+		Unknown:   make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		switch {
+		case page.Id != "":
+			if !seen[page.Id] {
+				seen[page.Id] = true
+				status.Deploys = append(status.Deploys, page.Id)
+			}
+		case page.Redirect != "":
+			status.Redirects = append(status.Redirects, page.Path)
+		default:
+			status.Unknown = append(status.Unknown, page.Path)
+		}
+	}
+
+	status.Mixed = len(status.Deploys) > 1
+
+	return status
+}
+
+// Status works out which deploy each live page is being served from.
+func (c *Client) Status(ctx context.Context, options Options) (result *StatusResult, err error) {
+	defer recoverError(&err)
+
+	start := time.Now()
+	r := c.start(ctx, options)
+
+	return &StatusResult{r.result(options, "status", start), r.siteStatus(options)}, nil
+}
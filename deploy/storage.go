@@ -0,0 +1,75 @@
+package deploy
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by a Storage when the key doesn't exist
+var ErrNotFound = errors.New("Not found")
+
+// Object is a stored file and the headers it is served with.
+type Object struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+
+	// The hex MD5 of the contents as stored (so after any compression), for objects which weren't
+	// uploaded in parts.  Only filled in by Head and List.
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+
+	// The hex MD5 the contents must have, checked by Put if it's set
+	MD5 string `json:"-"`
+
+	ContentType        string `json:"contentType,omitempty"`
+	ContentEncoding    string `json:"contentEncoding,omitempty"`
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	ContentLanguage    string `json:"contentLanguage,omitempty"`
+
+	// Objects with a RedirectLocation are served as a redirect to it, rather than their contents
+	RedirectLocation string `json:"redirectLocation,omitempty"`
+
+	// User metadata, the keys are always lowercase
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// Private objects (the lock) aren't served to anyone
+	Private bool `json:"private,omitempty"`
+}
+
+// Storage is somewhere deploys are written to: an S3 bucket (S3Storage) or a local directory served by
+// a web server (LocalStorage).  Every method can be called from many goroutines at once.
+type Storage interface {
+	// Name describes the storage in messages, it's the bucket name or the directory
+	Name() string
+
+	// Put writes obj.Size bytes of body to obj.Key, along with the headers and metadata in obj.
+	Put(obj Object, body io.Reader) error
+
+	// Copy copies the contents of the from key to obj.Key, replacing its headers and metadata with
+	// the ones in obj.
+	Copy(from string, obj Object) error
+
+	// Head returns the headers and metadata of key, or ErrNotFound.
+	Head(key string) (*Object, error)
+
+	// Get returns the contents of key, or ErrNotFound.
+	Get(key string) ([]byte, error)
+
+	// List returns every object whose key starts with prefix, sorted by key.  If delim isn't empty
+	// keys with delim after the prefix are grouped into the common prefixes instead, which end
+	// with delim.  Only the Key, Size, ETag and LastModified of the objects are filled in.
+	List(prefix, delim string) (objects []Object, prefixes []string, err error)
+
+	// Delete removes the keys, keys which don't exist are ignored.
+	Delete(keys []string) error
+}
+
+// listAll lists every object and common prefix under prefix
+func (r *run) listAll(prefix, delim string) ([]Object, []string) {
+	objects, prefixes, err := r.storage.List(prefix, delim)
+	panicIf(err)
+
+	return objects, prefixes
+}
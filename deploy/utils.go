@@ -0,0 +1,218 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/zackbloom/goamz/aws"
+	"github.com/zackbloom/goamz/cloudfront"
+	"github.com/zackbloom/goamz/iam"
+	"github.com/zackbloom/goamz/route53"
+	"github.com/zackbloom/goamz/s3"
+)
+
+const (
+	LIMITED = 60
+	FOREVER = 31556926
+)
+
+func getRegion(region string, s3Host string) aws.Region {
+	regionS, ok := aws.Regions[region]
+	if !ok {
+		panic(configError("Region not found"))
+	}
+
+	if s3Host != "" {
+		regionS.S3Endpoint = "https://" + s3Host
+		regionS.S3BucketEndpoint = "https://${bucket}." + s3Host
+	}
+	return regionS
+}
+
+func openS3(key, secret, region, s3Host string) *s3.S3 {
+	regionS := getRegion(region, s3Host)
+
+	auth := aws.Auth{
+		AccessKey: key,
+		SecretKey: secret,
+	}
+	return s3.New(auth, regionS)
+}
+
+func openIAM(key, secret, region string) *iam.IAM {
+	regionS := getRegion(region, "")
+
+	auth := aws.Auth{
+		AccessKey: key,
+		SecretKey: secret,
+	}
+	return iam.New(auth, regionS)
+}
+
+func openCloudFront(key, secret string) *cloudfront.CloudFront {
+	auth := aws.Auth{
+		AccessKey: key,
+		SecretKey: secret,
+	}
+	return cloudfront.NewCloudFront(auth)
+}
+
+func openRoute53(key, secret string) *route53.Route53 {
+	auth := aws.Auth{
+		AccessKey: key,
+		SecretKey: secret,
+	}
+
+	r53, _ := route53.NewRoute53(auth)
+	return r53
+}
+
+func panicIf(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+func must(val interface{}, err error) interface{} {
+	if err != nil {
+		panic(err)
+	}
+
+	return val
+}
+func mustString(val string, err error) string {
+	panicIf(err)
+	return val
+}
+func mustInt(val int, err error) int {
+	panicIf(err)
+	return val
+}
+
+// Options configure each command, they're the flags and config file of the command line tool.  ConfigFile,
+// Env, JSON and Output are only used by the command line tool itself, JSON is the deprecated --json flag
+// which is the same as an Output of json.
+type Options struct {
+	Files      string `yaml:"files"`
+	Root       string `yaml:"root"`
+	Dest       string `yaml:"dest"`
+	ConfigFile string `yaml:"-"`
+	Env        string `yaml:"-"`
+	Bucket     string `yaml:"bucket"`
+	Local      string `yaml:"local"`
+	AWSKey     string `yaml:"key"`
+	AWSSecret  string `yaml:"secret"`
+	AWSRegion  string `yaml:"region"`
+	S3Host     string `yaml:"s3Host"`
+	NoUser     bool   `yaml:"-"`
+	VersionAll bool   `yaml:"versionAll"`
+	JSON       bool   `yaml:"-"`
+	Output     string `yaml:"-"`
+	DryRun     bool   `yaml:"-"`
+	Keep       int    `yaml:"keep"`
+	KeepSince  string `yaml:"keepSince"`
+	Pin        string `yaml:"pin"`
+	HTMLRefs   string `yaml:"htmlRefs"`
+
+	MultipartThreshold int  `yaml:"multipartThreshold"`
+	GzipLevel          int  `yaml:"gzipLevel"`
+	Brotli             bool `yaml:"brotli"`
+	Precompressed      bool `yaml:"precompressed"`
+
+	// Nil for DEFAULT_BROTLI_LEVEL, as 0 is a level of its own
+	BrotliLevel *int `yaml:"brotliLevel"`
+
+	Compress   string `yaml:"compress"`
+	NoCompress string `yaml:"noCompress"`
+
+	Atomic       bool   `yaml:"atomic"`
+	Distribution string `yaml:"distribution"`
+	Origin       string `yaml:"origin"`
+
+	Lock        bool   `yaml:"lock"`
+	LockTTL     string `yaml:"lockTTL"`
+	ForceUnlock bool   `yaml:"-"`
+
+	RemoveNewPages   bool   `yaml:"-"`
+	RedirectNewPages string `yaml:"-"`
+	Yes              bool   `yaml:"-"`
+
+	// Only configurable in the config file
+	Headers   HeaderRules       `yaml:"headers"`
+	MimeTypes map[string]string `yaml:"mimeTypes"`
+}
+
+// The metadata key live copies of files are tagged with, so we can tell which deploy they came from
+const DEPLOY_META = "stout-deploy"
+
+// copyFile copies a file to a live path.  It is cached for LIMITED seconds, unless the headers
+// provide a Cache-Control of their own.
+func (r *run) copyFile(from string, to string, contentType string, contentEncoding string, headers Headers, id string) {
+	obj := Object{
+		Key:             to,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		CacheControl:    fmt.Sprintf("public, max-age=%d", LIMITED),
+	}
+
+	headers.apply(&obj)
+
+	if id != "" {
+		if obj.Meta == nil {
+			obj.Meta = make(map[string]string)
+		}
+		obj.Meta[DEPLOY_META] = id
+	}
+
+	if r.planned(PlannedAction{
+		Action:          "s3:CopyObject",
+		Path:            to,
+		From:            from,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		CacheControl:    obj.CacheControl,
+	}) {
+		return
+	}
+
+	panicIf(r.retry(func() error {
+		return r.storage.Copy(from, obj)
+	}, "copying "+from))
+
+	r.emit(Event{
+		Event:           "copied",
+		Path:            to,
+		From:            from,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+	})
+}
+
+func multipartThreshold(o Options) int64 {
+	return int64(o.MultipartThreshold) * 1024 * 1024
+}
+
+// destPrefix is the prefix of every key under the dest, for use with listAll
+func destPrefix(options Options) string {
+	dest := joinPath(options.Dest)
+	if dest == "." || dest == "/" {
+		return ""
+	}
+
+	return strings.TrimPrefix(dest, "/") + "/"
+}
+
+var pathRe = regexp.MustCompile("/{2,}")
+
+func joinPath(parts ...string) string {
+	// Like filepath.Join, but always uses '/'
+	out := filepath.Join(parts...)
+
+	if os.PathSeparator != '/' {
+		out = strings.Replace(out, string(os.PathSeparator), "/", -1)
+	}
+
+	return out
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+
+	"github.com/eagerio/stout/deploy"
 )
 
 func printUsage() {
-	fmt.Println(`Stout Static Deploy Tool
-Supports three commands, create, deploy and rollback.
+	fmt.Print(`Stout Static Deploy Tool
+Supports eight commands, create, deploy, rollback, list, status, prune, lock and unlock.
 
 Example Usage:
 
@@ -21,7 +25,24 @@ stout deploy --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET
 
 To rollback to a specific deploy:
 
-stout rollback --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET c4a22bf94de1
+stout rollback --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET c4a22bf94de13e1a75b0f6a8a6f5c0d9e2b7a5c8e1f4d3b2a190c8b7e6d5f4a3
+
+To list the deploys which have been made, newest first:
+
+stout list --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET
+
+To see which deploy each page of the site is being served from:
+
+stout status --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET
+
+To delete all but the ten most recent deploys (and the files only they use):
+
+stout prune --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET --keep 10
+
+To stop anyone deploying or rolling back while you deal with an incident, and then allow them again:
+
+stout lock --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET "Investigating the outage"
+stout unlock --bucket my.awesome.website --key AWS_KEY --secret AWS_SECRET
 
 See the README for more configuration information.
 `)
@@ -32,18 +53,43 @@ func main() {
 
 	command := flag.Arg(0)
 
+	var err error
 	switch command {
 	case "help":
 		printUsage()
 	case "deploy":
-		deployCmd()
+		err = deployCmd()
 	case "rollback":
-		rollbackCmd()
+		err = rollbackCmd()
 	case "create":
-		createCmd()
+		err = createCmd()
+	case "list", "history":
+		err = listCmd()
+	case "status":
+		err = statusCmd()
+	case "prune":
+		err = pruneCmd()
+	case "lock":
+		err = lockCmd()
+	case "unlock":
+		err = unlockCmd()
 	default:
 		fmt.Println("Command not understood")
 		fmt.Println("")
 		printUsage()
+		os.Exit(deploy.EXIT_CONFIG)
+	}
+
+	if err == context.Canceled {
+		err = &deploy.Error{Code: deploy.EXIT_CANCELLED, Message: "Interrupted"}
+	}
+
+	if err != nil {
+		if events != nil {
+			emitError(err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		os.Exit(deploy.ExitCode(err))
 	}
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+
+	"github.com/eagerio/stout/deploy"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func configError(message string) error {
+	return &deploy.Error{Code: deploy.EXIT_CONFIG, Message: message}
+}
+
+// newClient opens a client which writes its events when --output json is used, and asks the user
+// before removing pages if stdin is a terminal.
+func newClient(options deploy.Options) (*deploy.Client, error) {
+	client, err := deploy.NewClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Messages = stdout
+	if events != nil {
+		client.Progress = func(event deploy.Event) {
+			writeEvent(event)
+		}
+	}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		client.Confirm = confirm
+	}
+
+	return client, nil
+}
+
+// storageName is the bucket or directory the command works on, for messages
+func storageName(options deploy.Options) string {
+	if options.Local != "" {
+		return options.Local
+	}
+	return options.Bucket
+}
+
+// interruptContext is cancelled when the user presses Ctrl-C, which stops the command once the requests
+// it's making finish.  Pressing it again exits immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	return ctx
+}
+
+func deployCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Deploy(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		if err := printPlan(result.Plan, "Deploy "+result.Id); err != nil {
+			return err
+		}
+	}
+
+	if events != nil {
+		writeEvent(result)
+	} else if !result.DryRun {
+		printDeploy(result)
+	}
+	return nil
+}
+
+func rollbackCmd() error {
+	options, set, err := loadOptions()
+	if err != nil {
+		return err
+	}
+	version := set.Arg(0)
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Rollback(interruptContext(), options, version)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		if err := printPlan(result.Plan, "Rolling back to "+version); err != nil {
+			return err
+		}
+	}
+
+	writeEvent(result)
+	return nil
+}
+
+func createCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("aws"); err != nil {
+		fmt.Fprintln(stdout, "The aws CLI executable was not found in the PATH")
+		fmt.Fprintln(stdout, "Install it from http://aws.amazon.com/cli/ and try again")
+	}
+
+	result, err := client.Create(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		if err := printPlan(result.Plan, "Creating "+options.Bucket); err != nil {
+			return err
+		}
+	} else {
+		printCreate(options, result)
+	}
+
+	writeEvent(result)
+	return nil
+}
+
+func listCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.List(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	if events != nil {
+		writeEvent(result)
+		return nil
+	}
+	return printDeploys(result.Deploys)
+}
+
+func statusCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Status(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	if events != nil {
+		writeEvent(result)
+		return nil
+	}
+	return printStatus(result.SiteStatus)
+}
+
+func pruneCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Prune(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		if err := printPlan(result.Plan, fmt.Sprintf("Pruning %d deploys (reclaiming %s)", result.Deploys, deploy.FormatBytes(result.DeletedBytes))); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(stdout, "Pruned %d deploys and %d files, reclaiming %s\n", result.Deploys, result.Deleted, deploy.FormatBytes(result.DeletedBytes))
+	}
+
+	writeEvent(result)
+	return nil
+}
+
+func lockCmd() error {
+	options, set, err := loadOptions()
+	if err != nil {
+		return err
+	}
+	reason := strings.Join(set.Args(), " ")
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Lock(interruptContext(), options, reason)
+	if err != nil {
+		return err
+	}
+
+	if result.DryRun {
+		if err := printPlan(result.Plan, "Locking"); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(stdout, "%s is now %s\n", storageName(options)+"/"+result.Path, *result.Lock)
+	}
+
+	writeEvent(result)
+	return nil
+}
+
+func unlockCmd() error {
+	options, _, err := loadOptions()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Unlock(interruptContext(), options)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case result.Lock == nil:
+		fmt.Fprintln(stdout, "Not locked")
+	case result.DryRun:
+		if err := printPlan(result.Plan, "Unlocking"); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintf(stdout, "Removed the lock of %s\n", result.Lock.Owner)
+	}
+
+	writeEvent(result)
+	return nil
+}
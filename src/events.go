@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eagerio/stout/deploy"
+)
+
+// With --output json every command writes a stream of JSON events to stdout, one per line, ending with
+// a "result" event (or an "error" event if it failed).  Anything meant for people is written to stderr
+// instead, along with the logs.
+type eventWriter struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// events is set when --output json is used
+var events *eventWriter
+
+// stdout is where output meant for people goes, it's stderr when stdout is taken by the events
+var stdout io.Writer = os.Stdout
+
+func startEvents(o deploy.Options) error {
+	switch o.Output {
+	case "", "text":
+	case "json":
+		events = &eventWriter{enc: json.NewEncoder(os.Stdout)}
+		stdout = os.Stderr
+	default:
+		return configError("--output must be text or json, not " + o.Output)
+	}
+	return nil
+}
+
+// writeEvent writes an event, or the result of a command, if --output json is used.  Progress events
+// arrive from many goroutines at once.
+func writeEvent(event interface{}) {
+	if events == nil {
+		return
+	}
+
+	events.Lock()
+	defer events.Unlock()
+
+	events.enc.Encode(event)
+}
+
+// emitError reports the error a command failed with
+func emitError(err error) {
+	writeEvent(deploy.Event{
+		Event: "error",
+		Time:  time.Now().UTC(),
+		Error: err.Error(),
+		Code:  deploy.ExitCode(err),
+	})
+}
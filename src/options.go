@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/eagerio/stout/deploy"
+	"github.com/imdario/mergo"
+	homedir "github.com/mitchellh/go-homedir"
+	ini "github.com/sspencer/go-ini"
+	"gopkg.in/yaml.v1"
+)
+
+func parseOptions() (o deploy.Options, set *flag.FlagSet) {
+	set = flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	//TODO: Set set.Usage
+
+	set.StringVar(&o.Files, "files", "*", "Comma-seperated glob patterns of files to deploy (within root)")
+	set.StringVar(&o.Root, "root", "./", "The local directory to deploy")
+	set.StringVar(&o.Dest, "dest", "./", "The destination directory to write files to in the S3 bucket")
+	set.StringVar(&o.ConfigFile, "config", "", "A yaml file to read configuration from")
+	set.StringVar(&o.Env, "env", "", "The env to read from the config file")
+	set.StringVar(&o.Bucket, "bucket", "", "The bucket to deploy to")
+	set.StringVar(&o.Local, "local", "", "A local directory to deploy to instead of an S3 bucket, for sites served by nginx or another web server")
+	set.StringVar(&o.AWSKey, "key", "", "The AWS key to use")
+	set.StringVar(&o.AWSSecret, "secret", "", "The AWS secret of the provided key")
+	set.StringVar(&o.AWSRegion, "region", "us-east-1", "The AWS region the S3 bucket is in")
+	set.StringVar(&o.S3Host, "s3-host", "s3.amazonaws.com", "The hostname of an S3 implementation, overrides region")
+	set.BoolVar(&o.NoUser, "no-user", false, "When creating, should we make a user account?")
+	set.StringVar(&o.HTMLRefs, "html-refs", "", "Comma-seperated tag:attr pairs of html attributes which reference files to be versioned (scripts and stylesheets are always included)")
+	set.BoolVar(&o.JSON, "json", false, "Deprecated, the same as --output json")
+	set.StringVar(&o.Output, "output", "text", "The format of the output, text or json (a stream of events, one per line, ending with the result)")
+	set.BoolVar(&o.DryRun, "dry-run", false, "Print the requests deploy, rollback, create or prune would make, without making them")
+	set.IntVar(&o.Keep, "keep", 0, "When pruning, the number of most recent deploys to keep")
+	set.StringVar(&o.KeepSince, "keep-since", "", "When pruning, keep deploys made within this duration (i.e. 72h or 30d)")
+	set.StringVar(&o.Pin, "pin", "", "Comma-seperated deploy ids which should never be pruned")
+	set.IntVar(&o.MultipartThreshold, "multipart-threshold", 100, "Files larger than this many megabytes are uploaded in parts")
+	set.StringVar(&o.Compress, "compress", "", "Comma-seperated globs or MIME types of files which should be compressed, overriding the defaults")
+	set.StringVar(&o.NoCompress, "no-compress", "", "Comma-seperated globs or MIME types of files which should never be compressed")
+	set.IntVar(&o.GzipLevel, "gzip-level", 6, "The gzip compression level, from 1 (fastest) to 9 (smallest)")
+	set.BoolVar(&o.Brotli, "brotli", false, "Upload a brotli compressed variant of each compressible file to <path>.br (requires the brotli command)")
+	brotliLevel := set.Int("brotli-level", deploy.DEFAULT_BROTLI_LEVEL, "The brotli compression level, from 0 (fastest) to 11 (smallest)")
+	set.BoolVar(&o.Precompressed, "precompressed", false, "Upload the <path>.gz and <path>.br files our build writes next to a file as its compressed versions, rather than as files of their own")
+	set.BoolVar(&o.Atomic, "atomic", false, "Switch the whole site to each deploy at once, by pointing the CloudFront distribution at the deploy id")
+	set.StringVar(&o.Distribution, "distribution", "", "The id of the CloudFront distribution serving the site, for atomic deploys")
+	set.StringVar(&o.Origin, "origin", "", "The id of the distribution's origin which serves the site, if it has more than one")
+	set.BoolVar(&o.Lock, "lock", false, "Lock the dest while the deploy or rollback is made live, so others can't run at the same time")
+	set.StringVar(&o.LockTTL, "lock-ttl", "", "How long a lock lasts if it isn't removed (i.e. 30m or 2h), deploy locks last 15m and locks made with the lock command don't expire by default")
+	set.BoolVar(&o.ForceUnlock, "force-unlock", false, "Remove the lock of the dest even if someone else holds it")
+	set.BoolVar(&o.RemoveNewPages, "remove-new-pages", false, "When rolling back, delete the live html pages which were added after the deploy being restored")
+	set.StringVar(&o.RedirectNewPages, "redirect-new-pages", "", "When rolling back, redirect the live html pages which were added after the deploy being restored to this path")
+	set.BoolVar(&o.Yes, "yes", false, "Don't ask for confirmation before removing pages")
+	set.BoolVar(&o.VersionAll, "version-all", false, "Store every deployed file under the deploy id, so a rollback restores the entire site")
+
+	set.Parse(os.Args[2:])
+
+	// Left unset unless it's given, so the config file can set it
+	set.Visit(func(f *flag.Flag) {
+		if f.Name == "brotli-level" {
+			o.BrotliLevel = brotliLevel
+		}
+	})
+
+	return
+}
+
+// loadOptions reads the flags, the config file and the AWS credentials, which every command other than
+// a local deploy needs
+func loadOptions() (options deploy.Options, set *flag.FlagSet, err error) {
+	options, set = parseOptions()
+
+	if options.JSON {
+		fmt.Fprintln(os.Stderr, "--json is deprecated, use --output json instead")
+		options.Output = "json"
+	}
+
+	if err = startEvents(options); err != nil {
+		return
+	}
+	if err = loadConfigFile(&options); err != nil {
+		return
+	}
+	addAWSConfig(&options)
+
+	// Local deploys don't touch AWS at all
+	if options.Local != "" {
+		return
+	}
+
+	if options.Bucket == "" {
+		err = configError("You must specify a bucket")
+	} else if options.AWSKey == "" || options.AWSSecret == "" {
+		err = configError("You must specify your AWS credentials")
+	}
+	return
+}
+
+type ConfigFile map[string]deploy.Options
+
+func loadConfigFile(o *deploy.Options) error {
+	isDefault := false
+	configPath := o.ConfigFile
+	if o.ConfigFile == "" {
+		isDefault = true
+		configPath = "./deploy.yaml"
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) && isDefault {
+			return nil
+		}
+
+		return &deploy.Error{Code: deploy.EXIT_CONFIG, Message: "Unable to read " + configPath, Err: err}
+	}
+
+	var file ConfigFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return &deploy.Error{Code: deploy.EXIT_CONFIG, Message: "Unable to parse " + configPath, Err: err}
+	}
+
+	var envCfg deploy.Options
+	if o.Env != "" {
+		var ok bool
+		envCfg, ok = file[o.Env]
+		if !ok {
+			return configError("Config for specified env not found")
+		}
+	}
+
+	defCfg, _ := file["default"]
+
+	if err := mergo.MergeWithOverwrite(o, defCfg); err != nil {
+		return err
+	}
+	return mergo.MergeWithOverwrite(o, envCfg)
+}
+
+func addAWSConfig(o *deploy.Options) {
+	if o.AWSKey == "" && o.AWSSecret == "" {
+		o.AWSKey, o.AWSSecret = loadAWSConfig()
+	}
+}
+
+type AWSConfig struct {
+	Default struct {
+		AccessKey string `ini:"aws_access_key_id"`
+		SecretKey string `ini:"aws_secret_access_key"`
+	} `ini:"[default]"`
+}
+
+func loadAWSConfig() (access string, secret string) {
+	cfg := AWSConfig{}
+
+	for _, file := range []string{"~/.aws/config", "~/.aws/credentials"} {
+		path, err := homedir.Expand(file)
+		if err != nil {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		ini.Unmarshal(content, &cfg)
+
+		if cfg.Default.AccessKey != "" {
+			break
+		}
+	}
+
+	return cfg.Default.AccessKey, cfg.Default.SecretKey
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eagerio/stout/deploy"
+	"github.com/wsxiaoys/terminal/color"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func printPlan(plan []deploy.PlannedAction, summary string) error {
+	if events != nil {
+		writeEvent(struct {
+			Event   string                 `json:"event"`
+			Summary string                 `json:"summary"`
+			Actions []deploy.PlannedAction `json:"actions"`
+		}{"plan", summary, plan})
+		return nil
+	}
+
+	fmt.Printf("Dry run, nothing was changed.  %s would make %d requests:\n\n", summary, len(plan))
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, action := range plan {
+		switch action.Action {
+		case "s3:PutObject":
+			fmt.Fprintf(writer, "%s\t%s\t%d bytes, %s, %s, %s\n", action.Action, action.Path, action.Size, action.ContentType, action.ContentEncoding, action.CacheControl)
+		case "s3:DeleteObject":
+			fmt.Fprintf(writer, "%s\t%s\t%d bytes\n", action.Action, action.Path, action.Size)
+		case "s3:CopyObject":
+			fmt.Fprintf(writer, "%s\t%s\tfrom %s, %s, %s, %s\n", action.Action, action.Path, action.From, action.ContentType, action.ContentEncoding, action.CacheControl)
+		default:
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", action.Action, action.Path, action.Detail)
+		}
+	}
+	return writer.Flush()
+}
+
+// confirm asks the user a yes or no question, it's only used when stdin is a terminal
+func confirm(message string) bool {
+	fmt.Fprintf(stdout, "%s [y/N] ", message)
+
+	var answer string
+	fmt.Scanln(&answer)
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printDeploy(result *deploy.DeployResult) {
+	color.Printf(`
++-------------------------------------------------------------------------------+
+|                              @{g}Deploy Successful!@{|}                               |
+|                                                                               |
+|  Deploy ID: @{?}%-64s@{|}  |
++-------------------------------------------------------------------------------+
+`, result.Id)
+
+	fmt.Printf("Uploaded %d files (%s), skipped %d unchanged files (%s)\n", result.Uploaded, deploy.FormatBytes(result.UploadedBytes), result.Skipped, deploy.FormatBytes(result.SkippedBytes))
+}
+
+func printCreate(options deploy.Options, result *deploy.CreateResult) {
+	if !options.NoUser {
+		fmt.Fprintln(stdout, "An access key has been created with just the permissions required to deploy / rollback this site")
+		fmt.Fprint(stdout, "It is strongly recommended you use this limited account to deploy this project in the future\n\n")
+		fmt.Fprintf(stdout, "ACCESS_KEY_ID=%s\n", result.AccessKeyId)
+		fmt.Fprintf(stdout, "ACCESS_KEY_SECRET=%s\n\n", result.AccessKeySecret)
+
+		if terminal.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Fprintln(stdout, `You can either add these credentials to the deploy.yaml file,
+or specify them as arguments to the stout deploy / stout rollback commands.
+You MUST NOT add them to the deploy.yaml file if this project is public
+(i.e. a public GitHub repo).
+
+If you can't add them to the deploy.yaml file, you can specify them as
+arguments on the command line.  If you use a build system like CircleCI, you
+can add them as environment variables and pass those variables to the deploy
+commands (see the README).
+
+Your first deploy command might be:
+
+	stout deploy --bucket `+options.Bucket+` --key `+result.AccessKeyId+` --secret '`+result.AccessKeySecret+`'
+`)
+		}
+
+	}
+
+	fmt.Fprintln(stdout, "You can begin deploying now, but it can take up to ten minutes for your site to begin to work")
+	fmt.Fprintln(stdout, "Depending on the configuration of your site, you might need to set the 'root', 'dest' or 'files' options to get your deploys working as you wish.  See the README for details.")
+	fmt.Fprintln(stdout, "It's also a good idea to look into the 'env' option, as in real-world situations it usually makes sense to have a development and/or staging site for each of your production sites.")
+}
+
+func printDeploys(deploys []deploy.DeployInfo) error {
+	if len(deploys) == 0 {
+		fmt.Println("No deploys found")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTIME\tCOMMIT\tUSER\tLIVE")
+	for _, info := range deploys {
+		when := ""
+		if !info.Time.IsZero() {
+			when = info.Time.Local().Format("2006-01-02 15:04:05 MST")
+		}
+
+		ref := info.Ref
+		if len(ref) > 12 {
+			ref = ref[:12]
+		}
+
+		isLive := ""
+		if info.Live {
+			isLive = "*"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", info.Id, when, ref, info.User, isLive)
+	}
+	return writer.Flush()
+}
+
+func printStatus(status deploy.SiteStatus) error {
+	if len(status.Pages) == 0 {
+		fmt.Println("No html pages found")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "PAGE\tDEPLOY ID")
+	for _, page := range status.Pages {
+		id := page.Id
+		switch {
+		case page.Redirect != "":
+			id = "redirect to " + page.Redirect
+		case id == "":
+			id = "unknown"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\n", page.Path, id)
+	}
+	writer.Flush()
+
+	fmt.Println("")
+	switch {
+	case status.Mixed:
+		fmt.Printf("The site is in a mixed state, its pages are being served from %d different deploys\n", len(status.Deploys))
+	case len(status.Deploys) == 0:
+		fmt.Println("The live pages don't match any deploy")
+	default:
+		fmt.Printf("All pages are being served from deploy %s\n", status.Deploys[0])
+	}
+
+	if len(status.Deploys) != 0 && len(status.Unknown) != 0 {
+		fmt.Printf("%d pages don't match any deploy\n", len(status.Unknown))
+	}
+
+	return nil
+}